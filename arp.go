@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// ARP packet fields for IPv4 over Ethernet (RFC 826)
+const (
+	arpHardwareEthernet = 1
+	arpProtocolIPv4     = 0x0800
+	arpRequest          = 1
+	arpReply            = 2
+	arpPacketLen        = 28
+)
+
+// marshalARPRequest builds an ARP request from srcMAC and srcIP asking for
+// the hardware address of dstIP.
+func marshalARPRequest(srcMAC net.HardwareAddr, srcIP, dstIP net.IP) []byte {
+	b := make([]byte, arpPacketLen)
+	binary.BigEndian.PutUint16(b[0:2], arpHardwareEthernet)
+	binary.BigEndian.PutUint16(b[2:4], arpProtocolIPv4)
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:8], arpRequest)
+	copy(b[8:14], srcMAC)
+	copy(b[14:18], srcIP.To4())
+	// The target hardware address is left zero
+	copy(b[24:28], dstIP.To4())
+	return b
+}
+
+// parseARPReply returns the hardware address in an ARP reply from dstIP to
+// srcIP.
+func parseARPReply(b []byte, srcIP, dstIP net.IP) (net.HardwareAddr, bool) {
+	if len(b) < arpPacketLen ||
+		binary.BigEndian.Uint16(b[0:2]) != arpHardwareEthernet ||
+		binary.BigEndian.Uint16(b[2:4]) != arpProtocolIPv4 ||
+		b[4] != 6 || b[5] != 4 ||
+		binary.BigEndian.Uint16(b[6:8]) != arpReply {
+		return nil, false
+	}
+	if !net.IP(b[14:18]).Equal(dstIP) || !net.IP(b[24:28]).Equal(srcIP) {
+		return nil, false
+	}
+	return net.HardwareAddr(append([]byte(nil), b[8:14]...)), true
+}
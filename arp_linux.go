@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// arpPinger broadcasts ARP requests for the target on the interface owning
+// its subnet and reports the replies of every host claiming the address.
+type arpPinger struct {
+	file    *os.File
+	conn    syscall.RawConn
+	ifindex int
+	srcMAC  net.HardwareAddr
+	srcIP   net.IP
+	dstIP   net.IP
+	results chan<- transportResult
+	matcher neighborMatcher
+
+	closeOnce sync.Once
+}
+
+func newARPPinger(dstAddr *net.IPAddr, module Module, results chan<- transportResult) (transportPinger, error) {
+	if dstAddr.IP.To4() == nil {
+		return nil, fmt.Errorf("ARP needs an IPv4 target, not %s", dstAddr.IP)
+	}
+	p := &arpPinger{dstIP: dstAddr.IP.To4(), results: results}
+	if err := withNetNS(module.NetNS, func() error { return p.open(module) }); err != nil {
+		return nil, err
+	}
+	go p.readLoop()
+	return p, nil
+}
+
+func (p *arpPinger) open(module Module) error {
+	ifi, srcIP, err := arpInterface(p.dstIP, module)
+	if err != nil {
+		return err
+	}
+	p.ifindex, p.srcMAC, p.srcIP = ifi.Index, ifi.HardwareAddr, srcIP
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: ifi.Index}); err != nil {
+		unix.Close(fd)
+		return os.NewSyscallError("bind", err)
+	}
+	// A non-blocking file is polled by the runtime, so closing it ends a
+	// pending read.
+	p.file = os.NewFile(uintptr(fd), "arp")
+	p.conn, err = p.file.SyscallConn()
+	if err != nil {
+		p.file.Close()
+		return err
+	}
+	return nil
+}
+
+// arpInterface returns the Ethernet interface to send ARP requests for dst
+// from, and the source address to send them with: source_interface if
+// set, or else the interface with an address on the subnet of dst.
+func arpInterface(dst net.IP, module Module) (*net.Interface, net.IP, error) {
+	var ifaces []net.Interface
+	if module.SourceInterface != "" {
+		ifi, err := net.InterfaceByName(module.SourceInterface)
+		if err != nil {
+			return nil, nil, fmt.Errorf("source interface %q does not exist", module.SourceInterface)
+		}
+		if len(ifi.HardwareAddr) != 6 {
+			return nil, nil, fmt.Errorf("source interface %q is not an Ethernet interface", module.SourceInterface)
+		}
+		ifaces = []net.Interface{*ifi}
+	} else {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ifi := range all {
+			if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagLoopback == 0 && len(ifi.HardwareAddr) == 6 {
+				ifaces = append(ifaces, ifi)
+			}
+		}
+	}
+	srcIP := net.ParseIP(module.SourceIP).To4()
+
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, nil, err
+		}
+		var first net.IP
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			if first == nil {
+				first = ipnet.IP.To4()
+			}
+			if ipnet.Contains(dst) && !ipnet.IP.Equal(dst) && (srcIP == nil || ipnet.IP.Equal(srcIP)) {
+				return &ifi, ipnet.IP.To4(), nil
+			}
+		}
+		// The source interface is used even if the target is off its
+		// subnets, e.g. for point-to-point addressing
+		if module.SourceInterface != "" {
+			if srcIP != nil {
+				return &ifi, srcIP, nil
+			}
+			if first == nil {
+				return nil, nil, fmt.Errorf("source interface %q has no IPv4 address", module.SourceInterface)
+			}
+			return &ifi, first, nil
+		}
+	}
+	if srcIP != nil {
+		return nil, nil, fmt.Errorf("no interface with source IP %s has a subnet containing %s", srcIP, dst)
+	}
+	return nil, nil, fmt.Errorf("%s is not on a directly connected Ethernet subnet", dst)
+}
+
+func (p *arpPinger) start(index int) (time.Time, error) {
+	request := marshalARPRequest(p.srcMAC, p.srcIP, p.dstIP)
+	to := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  p.ifindex,
+		Halen:    6,
+		Addr:     [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+
+	// Recorded first, as the reply may arrive before Sendto returns
+	p.matcher.sent(index)
+	sent := time.Now()
+	var err error
+	if werr := p.conn.Write(func(fd uintptr) bool {
+		err = unix.Sendto(int(fd), request, 0, to)
+		return err != unix.EAGAIN
+	}); werr != nil {
+		err = werr
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to send ARP request: %w", os.NewSyscallError("sendto", err))
+	}
+	return sent, nil
+}
+
+// readLoop reports the ARP replies from the target until the socket is
+// closed.
+func (p *arpPinger) readLoop() {
+	b := make([]byte, 1500)
+	for {
+		var n int
+		var err error
+		if rerr := p.conn.Read(func(fd uintptr) bool {
+			n, _, err = unix.Recvfrom(int(fd), b, 0)
+			return err != unix.EAGAIN
+		}); rerr != nil {
+			return
+		}
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return
+		}
+		received := time.Now()
+		mac, ok := parseARPReply(b[:n], p.srcIP, p.dstIP)
+		if !ok {
+			continue
+		}
+
+		responder := mac.String()
+		index, ok := p.matcher.match(responder)
+		if !ok {
+			continue
+		}
+		select {
+		case p.results <- transportResult{index: index, received: received, responder: responder}:
+		default:
+		}
+	}
+}
+
+func (p *arpPinger) close() {
+	p.closeOnce.Do(func() { p.file.Close() })
+}
+
+// htons converts a 16 bit value to network byte order, as the packet
+// socket calls want the protocol.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
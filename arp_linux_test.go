@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+)
+
+// runIP runs the ip command in the network namespace netns.
+func runIP(t *testing.T, netns string, args ...string) {
+	t.Helper()
+	err := withNetNS(netns, func() error {
+		out, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			t.Logf("ip %v: %s", args, out)
+		}
+		return err
+	})
+	if err != nil {
+		t.Skipf("Cannot set up links in this environment: %v", err)
+	}
+}
+
+func TestPerformTransportPingARP(t *testing.T) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip command not found")
+	}
+	logger := promslog.New(&promslog.Config{})
+
+	// The prober owns 192.0.2.1 on one end of a veth pair. Both the other
+	// end and a macvlan on top of it answer for 192.0.2.2, as two hosts
+	// with conflicting addresses would.
+	prober, hosts := newTestNetNS(t), newTestNetNS(t)
+	runIP(t, prober, "link", "add", "arp0", "type", "veth", "peer", "name", "arp1")
+	runIP(t, prober, "link", "set", "arp1", "netns", hosts)
+	runIP(t, prober, "addr", "add", "192.0.2.1/24", "dev", "arp0")
+	runIP(t, prober, "link", "set", "arp0", "up")
+	runIP(t, hosts, "link", "add", "mv0", "link", "arp1", "type", "macvlan", "mode", "bridge")
+	runIP(t, hosts, "addr", "add", "192.0.2.2/24", "dev", "arp1")
+	runIP(t, hosts, "addr", "add", "192.0.2.3/24", "dev", "mv0")
+	runIP(t, hosts, "link", "set", "arp1", "up")
+	runIP(t, hosts, "link", "set", "mv0", "up")
+
+	tests := []struct {
+		target         string
+		wantReceived   int
+		wantResponders int
+	}{
+		{target: "192.0.2.2", wantReceived: 3, wantResponders: 2},
+		{target: "192.0.2.4", wantReceived: 0, wantResponders: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			module := Module{Count: 3, Interval: 10 * time.Millisecond, Timeout: 5 * time.Second, PacketTimeout: 500 * time.Millisecond, IPProtocol: "ip4", Protocol: protocolARP, NetNS: prober}
+			ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+			defer cancel()
+			stats, err := performTransportPing(ctx, &net.IPAddr{IP: net.ParseIP(tt.target)}, module, logger)
+			if err != nil {
+				t.Fatalf("performTransportPing() error = %v", err)
+			}
+			if stats.PacketsSent != module.Count || stats.PacketsReceived != tt.wantReceived {
+				t.Errorf("PacketsSent = %d, PacketsReceived = %d, want %d, %d", stats.PacketsSent, stats.PacketsReceived, module.Count, tt.wantReceived)
+			}
+			if len(stats.NeighborResponders) != tt.wantResponders {
+				t.Errorf("NeighborResponders = %v, want %d responders", stats.NeighborResponders, tt.wantResponders)
+			}
+		})
+	}
+
+	module := Module{Count: 1, Interval: time.Second, Timeout: time.Second, PacketTimeout: time.Second, IPProtocol: "ip4", Protocol: protocolARP, NetNS: prober}
+	if _, err := performTransportPing(context.Background(), &net.IPAddr{IP: net.ParseIP("198.51.100.1")}, module, logger); err == nil {
+		t.Error("performTransportPing() succeeded for a target off the connected subnets")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// newARPPinger fails: ARP pings are only supported on Linux.
+func newARPPinger(dstAddr *net.IPAddr, module Module, results chan<- transportResult) (transportPinger, error) {
+	return nil, errors.New("protocol arp is only supported on Linux")
+}
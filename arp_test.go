@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseARPReply(t *testing.T) {
+	srcMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	dstMAC, _ := net.ParseMAC("02:00:00:00:00:02")
+	srcIP, dstIP := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+
+	// A reply is the request with the addresses swapped and filled in
+	reply := func() []byte {
+		b := marshalARPRequest(dstMAC, dstIP, srcIP)
+		b[7] = arpReply
+		copy(b[18:24], srcMAC)
+		return b
+	}
+
+	if mac, ok := parseARPReply(reply(), srcIP, dstIP); !ok || mac.String() != dstMAC.String() {
+		t.Errorf("parseARPReply() = %v, %v, want %v, true", mac, ok, dstMAC)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(b []byte) []byte
+	}{
+		{name: "request", modify: func(b []byte) []byte { b[7] = arpRequest; return b }},
+		{name: "other sender", modify: func(b []byte) []byte { b[17] = 3; return b }},
+		{name: "other target", modify: func(b []byte) []byte { b[27] = 3; return b }},
+		{name: "not IPv4", modify: func(b []byte) []byte { b[2] = 0x86; return b }},
+		{name: "short", modify: func(b []byte) []byte { return b[:20] }},
+	}
+	for _, tt := range tests {
+		if _, ok := parseARPReply(tt.modify(reply()), srcIP, dstIP); ok {
+			t.Errorf("%s: parseARPReply() accepted the packet", tt.name)
+		}
+	}
+}
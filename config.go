@@ -0,0 +1,673 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultModuleName is the module used when a probe request does not name one.
+const defaultModuleName = "default"
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ping_exporter",
+		Name:      "config_last_reload_successful",
+		Help:      "Ping exporter config loaded successfully.",
+	})
+
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ping_exporter",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess)
+	prometheus.MustRegister(configReloadSeconds)
+}
+
+// Config is the content of the file passed with --config.file.
+type Config struct {
+	Modules map[string]Module `yaml:"modules"`
+}
+
+// Module is a named set of probe settings, selected with the module query
+// parameter. Settings left out of the config file fall back to the
+// --ping.default-* flags.
+type Module struct {
+	Count         int           `yaml:"count,omitempty"`
+	Interval      time.Duration `yaml:"interval,omitempty"`
+	PacketSize    int           `yaml:"packet_size,omitempty"`
+	Timeout       time.Duration `yaml:"timeout,omitempty"`
+	PacketTimeout time.Duration `yaml:"packet_timeout,omitempty"`
+	IPProtocol    string        `yaml:"ip_protocol,omitempty"`
+	SourceIP      string        `yaml:"source_ip,omitempty"`
+	DontFragment  bool          `yaml:"dont_fragment,omitempty"`
+
+	// Protocol is the protocol of the echo: icmp, tcp handshakes or udp
+	// datagrams with Port, or arp requests or ndp neighbor solicitations.
+	Protocol string `yaml:"protocol,omitempty"`
+	Port     int    `yaml:"port,omitempty"`
+	// Mode selects the kind of probe: echo, pmtu, traceroute or timestamp.
+	Mode string `yaml:"mode,omitempty"`
+	// MaxHops is the highest TTL tried in traceroute mode.
+	MaxHops int `yaml:"max_hops,omitempty"`
+	// SocketMode overrides --ping.socket-mode for the module.
+	SocketMode string `yaml:"socket_mode,omitempty"`
+	// SourceInterface binds the probe's sockets to a network interface or
+	// VRF device (Linux only).
+	SourceInterface string `yaml:"source_interface,omitempty"`
+	// NetNS is the network namespace to probe from: a name created with
+	// `ip netns add` or a /proc/<pid>/ns/net path (Linux only).
+	NetNS string `yaml:"netns,omitempty"`
+	// NetNSResolve resolves the target with DNS queries sent from inside
+	// NetNS rather than from the exporter's namespace.
+	NetNSResolve bool `yaml:"netns_resolve,omitempty"`
+	// FWMark is the firewall mark (SO_MARK) of the echo requests, used to
+	// select a policy routing table (Linux only).
+	FWMark uint32 `yaml:"fwmark,omitempty"`
+	// KernelTimestamps takes send and receive times from the kernel
+	// instead of userspace where the platform supports it.
+	KernelTimestamps bool `yaml:"kernel_timestamps,omitempty"`
+	// TTL is the IPv4 TTL or IPv6 hop limit of the echo requests. Zero
+	// keeps the system default.
+	TTL int `yaml:"ttl,omitempty"`
+	// TOS is the IPv4 TOS byte or IPv6 traffic class of the echo
+	// requests. The dscp query parameter sets its upper six bits.
+	TOS int `yaml:"tos,omitempty"`
+
+	// AllowedOverrides lists the query parameters that may override the
+	// settings above for a single probe request.
+	AllowedOverrides []string `yaml:"allowed_overrides,omitempty"`
+}
+
+// probeParams maps every query parameter that can override a module
+// setting to the function parsing it into the module.
+var probeParams = map[string]func(m *Module, value string) error{
+	"count": func(m *Module, value string) error {
+		c, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		m.Count = c
+		return nil
+	},
+	"interval": func(m *Module, value string) error {
+		i, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("not a valid duration")
+		}
+		m.Interval = i
+		return nil
+	},
+	"packet_size": func(m *Module, value string) error {
+		s, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		m.PacketSize = s
+		return nil
+	},
+	"timeout": func(m *Module, value string) error {
+		t, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("not a valid duration")
+		}
+		m.Timeout = t
+		return nil
+	},
+	"packet_timeout": func(m *Module, value string) error {
+		t, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("not a valid duration")
+		}
+		m.PacketTimeout = t
+		return nil
+	},
+	"ip_protocol": func(m *Module, value string) error {
+		m.IPProtocol = value
+		return nil
+	},
+	"source_ip": func(m *Module, value string) error {
+		m.SourceIP = value
+		return nil
+	},
+	"source_interface": func(m *Module, value string) error {
+		m.SourceInterface = value
+		return nil
+	},
+	"netns": func(m *Module, value string) error {
+		m.NetNS = value
+		return nil
+	},
+	"netns_resolve": func(m *Module, value string) error {
+		resolve, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+		m.NetNSResolve = resolve
+		return nil
+	},
+	"fwmark": func(m *Module, value string) error {
+		mark, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return fmt.Errorf("not a 32 bit unsigned integer")
+		}
+		m.FWMark = uint32(mark)
+		return nil
+	},
+	"dont_fragment": func(m *Module, value string) error {
+		df, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+		m.DontFragment = df
+		return nil
+	},
+	"protocol": func(m *Module, value string) error {
+		m.Protocol = value
+		return nil
+	},
+	"port": func(m *Module, value string) error {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		m.Port = port
+		return nil
+	},
+	"mode": func(m *Module, value string) error {
+		m.Mode = value
+		return nil
+	},
+	"max_hops": func(m *Module, value string) error {
+		hops, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		m.MaxHops = hops
+		return nil
+	},
+	"socket_mode": func(m *Module, value string) error {
+		m.SocketMode = value
+		return nil
+	},
+	"kernel_timestamps": func(m *Module, value string) error {
+		ts, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+		m.KernelTimestamps = ts
+		return nil
+	},
+	"tos": func(m *Module, value string) error {
+		tos, err := strconv.ParseInt(value, 0, 0)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		m.TOS = int(tos)
+		return nil
+	},
+	"dscp": func(m *Module, value string) error {
+		dscp, err := parseDSCP(value)
+		if err != nil {
+			return err
+		}
+		m.TOS = dscp << 2
+		return nil
+	},
+	"ttl": func(m *Module, value string) error {
+		ttl, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		m.TTL = ttl
+		return nil
+	},
+}
+
+// netnsPattern matches the names of `ip netns` namespaces and the network
+// namespace files of processes.
+var netnsPattern = regexp.MustCompile(`^([A-Za-z0-9_][A-Za-z0-9_.-]*|/proc/[0-9]+/ns/net)$`)
+
+// dscpNames maps the per-hop behaviour names of RFC 2474, 2597 and 3246 to
+// their code points.
+var dscpNames = map[string]int{
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14,
+	"AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30,
+	"AF41": 34, "AF42": 36, "AF43": 38,
+	"EF": 46,
+}
+
+// parseDSCP parses a DSCP given as a number or a per-hop behaviour name
+// such as EF or AF41.
+func parseDSCP(value string) (int, error) {
+	if dscp, ok := dscpNames[strings.ToUpper(value)]; ok {
+		return dscp, nil
+	}
+	dscp, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("not a number or DSCP name")
+	}
+	if dscp < 0 || dscp > 63 {
+		return 0, fmt.Errorf("dscp must be between 0 and 63")
+	}
+	return dscp, nil
+}
+
+// paramError describes why a probe request was rejected. Reason is used as
+// the label of the rejected requests counter.
+type paramError struct {
+	Reason  string
+	Message string
+}
+
+func (e paramError) Error() string {
+	return e.Message
+}
+
+// defaultModule returns the module built from the --ping.default-* flags.
+// It allows every probe parameter to be overridden, which matches the
+// behaviour of the exporter before modules existed, except those in
+// restrictedParams.
+func defaultModule() Module {
+	m := Module{
+		Count:         *defaultCount,
+		Interval:      *defaultInterval,
+		PacketSize:    *defaultPacketSize,
+		Timeout:       *defaultTimeout,
+		PacketTimeout: *defaultPacketTimeout,
+		IPProtocol:    "ip4",
+		Protocol:      protocolICMP,
+		Mode:          modeEcho,
+		MaxHops:       30,
+		SocketMode:    *socketMode,
+	}
+	for name := range probeParams {
+		if !restrictedParams[name] {
+			m.AllowedOverrides = append(m.AllowedOverrides, name)
+		}
+	}
+	sort.Strings(m.AllowedOverrides)
+	return m
+}
+
+// restrictedParams lists the probe parameters that reach beyond the
+// exporter's own network stack, such as the network namespaces of other
+// processes or the routing tables selected by firewall marks and by
+// binding to VRF devices. Only modules listing them in allowed_overrides
+// accept them.
+var restrictedParams = map[string]bool{
+	"netns":            true,
+	"netns_resolve":    true,
+	"fwmark":           true,
+	"source_interface": true,
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. Modules from the config file
+// start from the flag defaults but allow no overrides unless listed.
+func (m *Module) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*m = defaultModule()
+	m.AllowedOverrides = nil
+	type plain Module
+	return unmarshal((*plain)(m))
+}
+
+// moduleCheck is a validation rule for the module settings that the probe
+// parameters in params control.
+type moduleCheck struct {
+	params []string
+	check  func(m *Module) error
+}
+
+// moduleChecks lists the validation rules in the order they are reported.
+// Rules for a single parameter come before the rules combining it with
+// others, so that an invalid value is reported once, as such.
+var moduleChecks = []moduleCheck{
+	{[]string{"count"}, func(m *Module) error {
+		if m.Count <= 0 || m.Count > *maxCount {
+			return fmt.Errorf("count must be between 1 and %d", *maxCount)
+		}
+		return nil
+	}},
+	{[]string{"interval"}, func(m *Module) error {
+		if m.Interval <= 0 {
+			return fmt.Errorf("interval must be positive")
+		}
+		return nil
+	}},
+	{[]string{"packet_size"}, func(m *Module) error {
+		if m.PacketSize <= 0 || m.PacketSize > *maxPacketSize {
+			return fmt.Errorf("packet_size must be between 1 and %d", *maxPacketSize)
+		}
+		return nil
+	}},
+	{[]string{"timeout"}, func(m *Module) error {
+		if m.Timeout <= 0 {
+			return fmt.Errorf("timeout must be positive")
+		}
+		return nil
+	}},
+	{[]string{"packet_timeout"}, func(m *Module) error {
+		if m.PacketTimeout <= 0 {
+			return fmt.Errorf("packet_timeout must be positive")
+		}
+		return nil
+	}},
+	{[]string{"ip_protocol"}, func(m *Module) error {
+		switch m.IPProtocol {
+		case "ip4", "ip6", "auto":
+			return nil
+		}
+		return fmt.Errorf("ip_protocol must be one of ip4, ip6 or auto")
+	}},
+	{[]string{"mode"}, func(m *Module) error {
+		switch m.Mode {
+		case modeEcho, modePMTU, modeTraceroute, modeTimestamp:
+			return nil
+		}
+		return fmt.Errorf("mode must be one of echo, pmtu, traceroute or timestamp")
+	}},
+	{[]string{"ip_protocol", "mode"}, func(m *Module) error {
+		if m.Mode == modeTimestamp && m.IPProtocol == "ip6" {
+			return fmt.Errorf("mode timestamp requires ip_protocol ip4 or auto")
+		}
+		return nil
+	}},
+	{[]string{"protocol"}, func(m *Module) error {
+		switch m.Protocol {
+		case protocolICMP, protocolTCP, protocolUDP, protocolARP, protocolNDP:
+			return nil
+		}
+		return fmt.Errorf("protocol must be one of icmp, tcp, udp, arp or ndp")
+	}},
+	{[]string{"ip_protocol", "protocol"}, func(m *Module) error {
+		switch {
+		case m.Protocol == protocolARP && m.IPProtocol == "ip6":
+			return fmt.Errorf("protocol arp requires ip_protocol ip4 or auto")
+		case m.Protocol == protocolNDP && m.IPProtocol == "ip4":
+			return fmt.Errorf("protocol ndp requires ip_protocol ip6 or auto")
+		}
+		return nil
+	}},
+	{[]string{"port", "protocol"}, func(m *Module) error {
+		if (m.Protocol == protocolTCP || m.Protocol == protocolUDP) && (m.Port < 1 || m.Port > 65535) {
+			return fmt.Errorf("port must be between 1 and 65535 for protocol %s", m.Protocol)
+		}
+		return nil
+	}},
+	{[]string{"mode", "protocol"}, func(m *Module) error {
+		if m.Protocol != protocolICMP && m.Mode != modeEcho {
+			return fmt.Errorf("mode %s requires protocol icmp", m.Mode)
+		}
+		return nil
+	}},
+	{[]string{"max_hops"}, func(m *Module) error {
+		if m.MaxHops < 1 || m.MaxHops > 255 {
+			return fmt.Errorf("max_hops must be between 1 and 255")
+		}
+		return nil
+	}},
+	{[]string{"socket_mode"}, func(m *Module) error {
+		switch m.SocketMode {
+		case socketModeAuto, socketModePrivileged, socketModeUnprivileged:
+			return nil
+		}
+		return fmt.Errorf("socket_mode must be one of auto, privileged or unprivileged")
+	}},
+	{[]string{"dont_fragment", "socket_mode"}, func(m *Module) error {
+		if m.SocketMode == socketModeUnprivileged && m.DontFragment {
+			return fmt.Errorf("dont_fragment requires socket_mode privileged or auto")
+		}
+		return nil
+	}},
+	{[]string{"protocol", "socket_mode"}, func(m *Module) error {
+		if m.SocketMode == socketModeUnprivileged && (m.Protocol == protocolARP || m.Protocol == protocolNDP) {
+			return fmt.Errorf("protocol %s requires socket_mode privileged or auto", m.Protocol)
+		}
+		return nil
+	}},
+	{[]string{"mode", "socket_mode"}, func(m *Module) error {
+		if m.SocketMode == socketModeUnprivileged && m.Mode == modeTimestamp {
+			return fmt.Errorf("mode timestamp requires socket_mode privileged or auto")
+		}
+		return nil
+	}},
+	{[]string{"ip_protocol", "mode", "socket_mode"}, func(m *Module) error {
+		// Only raw sockets set the Don't Fragment bit of IPv4 packets
+		if m.SocketMode == socketModeUnprivileged && m.Mode == modePMTU && m.IPProtocol != "ip6" {
+			return fmt.Errorf("mode pmtu requires socket_mode privileged or auto, or ip_protocol ip6")
+		}
+		return nil
+	}},
+	{[]string{"ttl"}, func(m *Module) error {
+		if m.TTL < 0 || m.TTL > 255 {
+			return fmt.Errorf("ttl must be between 1 and 255, or 0 for the system default")
+		}
+		return nil
+	}},
+	{[]string{"source_interface"}, func(m *Module) error {
+		if len(m.SourceInterface) > 15 || strings.ContainsAny(m.SourceInterface, "/ ") {
+			return fmt.Errorf("source_interface %q is not a valid interface name", m.SourceInterface)
+		}
+		return nil
+	}},
+	{[]string{"netns"}, func(m *Module) error {
+		if m.NetNS != "" && !netnsPattern.MatchString(m.NetNS) {
+			return fmt.Errorf("netns %q must be a namespace name or a /proc/<pid>/ns/net path", m.NetNS)
+		}
+		return nil
+	}},
+	{[]string{"dscp", "tos"}, func(m *Module) error {
+		if m.TOS < 0 || m.TOS > 255 {
+			return fmt.Errorf("tos must be between 0 and 255")
+		}
+		return nil
+	}},
+	{[]string{"source_ip"}, func(m *Module) error {
+		if m.SourceIP != "" && net.ParseIP(m.SourceIP) == nil {
+			return fmt.Errorf("source_ip %q is not a valid IP address", m.SourceIP)
+		}
+		return nil
+	}},
+}
+
+func (m *Module) validate() error {
+	for _, c := range moduleChecks {
+		if err := c.check(m); err != nil {
+			return err
+		}
+	}
+	for _, name := range m.AllowedOverrides {
+		if _, ok := probeParams[name]; !ok {
+			return fmt.Errorf("unknown parameter %q in allowed_overrides", name)
+		}
+	}
+	return nil
+}
+
+func (m *Module) overrideAllowed(name string) bool {
+	for _, allowed := range m.AllowedOverrides {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOverrides returns a copy of the module with the probe parameters from
+// the query applied. Parameters the module does not allow to be overridden
+// are always rejected. Values that cannot be parsed, or that are out of range
+// alone or combined with the other settings, are rejected too, unless
+// lenient is set, in which case the module settings are kept instead.
+func (m Module) applyOverrides(moduleName string, params url.Values, lenient bool) (Module, []paramError) {
+	names := make([]string, 0, len(probeParams))
+	for name := range probeParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []paramError
+	invalid := func(names []string, err error) {
+		if lenient {
+			return
+		}
+		values := make([]string, len(names))
+		for i, name := range names {
+			values[i] = fmt.Sprintf("%s=%q", name, params.Get(name))
+		}
+		message := fmt.Sprintf("invalid parameter %s: %s", values[0], err)
+		if len(values) > 1 {
+			message = fmt.Sprintf("invalid parameters %s: %s", strings.Join(values, ", "), err)
+		}
+		errs = append(errs, paramError{Reason: "invalid_" + names[0], Message: message})
+	}
+
+	// Every override is parsed first, so that rules combining several
+	// parameters see all of them.
+	applied := map[string]bool{}
+	for _, name := range names {
+		value := params.Get(name)
+		if value == "" {
+			continue
+		}
+		if !m.overrideAllowed(name) {
+			errs = append(errs, paramError{
+				Reason:  "override_not_allowed",
+				Message: fmt.Sprintf("parameter %q may not be overridden in module %q", name, moduleName),
+			})
+			continue
+		}
+		if err := probeParams[name](&Module{}, value); err != nil {
+			invalid([]string{name}, err)
+			continue
+		}
+		applied[name] = true
+	}
+	if applied["dscp"] && applied["tos"] {
+		// Both set the same byte
+		invalid([]string{"dscp", "tos"}, fmt.Errorf("dscp and tos are mutually exclusive"))
+		delete(applied, "dscp")
+		delete(applied, "tos")
+	}
+
+	// The module itself is valid, so a failing rule is down to the
+	// overrides among its parameters. Those are reported, or dropped in
+	// lenient mode, until the remaining overrides pass every rule.
+	for {
+		merged := m
+		for _, name := range names {
+			if applied[name] {
+				probeParams[name](&merged, params.Get(name))
+			}
+		}
+
+		reported := map[string]bool{}
+		retry := false
+	checks:
+		for _, c := range moduleChecks {
+			var overridden []string
+			for _, name := range c.params {
+				if reported[name] {
+					continue checks
+				}
+				if applied[name] {
+					overridden = append(overridden, name)
+				}
+			}
+			if len(overridden) == 0 {
+				continue
+			}
+			err := c.check(&merged)
+			if err == nil {
+				continue
+			}
+			invalid(overridden, err)
+			for _, name := range overridden {
+				reported[name] = true
+				delete(applied, name)
+			}
+			if lenient {
+				// Dropping overrides may fix or break other rules
+				retry = true
+				break
+			}
+		}
+		if !retry {
+			return merged, errs
+		}
+	}
+}
+
+// loadConfig reads and validates the config file. An empty filename yields
+// a config holding only the default module.
+func loadConfig(filename string) (*Config, error) {
+	c := &Config{}
+	if filename != "" {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(content, c); err != nil {
+			return nil, fmt.Errorf("error parsing config file: %w", err)
+		}
+	}
+	if c.Modules == nil {
+		c.Modules = map[string]Module{}
+	}
+	if _, ok := c.Modules[defaultModuleName]; !ok {
+		c.Modules[defaultModuleName] = defaultModule()
+	}
+	for name, module := range c.Modules {
+		if err := module.validate(); err != nil {
+			return nil, fmt.Errorf("invalid module %q: %w", name, err)
+		}
+	}
+	return c, nil
+}
+
+// SafeConfig holds the active config. Probes take the current config when
+// they start, so swapping it on reload does not affect probes in flight.
+type SafeConfig struct {
+	sync.RWMutex
+	C *Config
+}
+
+// Get returns the active config.
+func (sc *SafeConfig) Get() *Config {
+	sc.RLock()
+	defer sc.RUnlock()
+	return sc.C
+}
+
+// ReloadConfig loads the config file and makes it the active config. An
+// invalid config is rejected and the previous config stays active.
+func (sc *SafeConfig) ReloadConfig(filename string) error {
+	c, err := loadConfig(filename)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+
+	sc.Lock()
+	sc.C = c
+	sc.Unlock()
+
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	return nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func setTestFlagDefaults() {
+	*defaultCount = 3
+	*defaultInterval = time.Second
+	*defaultPacketSize = 64
+	*defaultTimeout = 5 * time.Second
+	*defaultPacketTimeout = 2 * time.Second
+	*socketMode = "auto"
+	*maxCount = 100
+	*maxPacketSize = 65507
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "ping.yml")
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return filename
+}
+
+func TestLoadConfig(t *testing.T) {
+	setTestFlagDefaults()
+
+	filename := writeConfigFile(t, `
+modules:
+  lan_fast:
+    count: 10
+    interval: 100ms
+    timeout: 2s
+    allowed_overrides: [packet_size]
+  wan:
+    ip_protocol: ip6
+    dont_fragment: true
+`)
+
+	conf, err := loadConfig(filename)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	lanFast, ok := conf.Modules["lan_fast"]
+	if !ok {
+		t.Fatal("Module lan_fast not loaded")
+	}
+	if lanFast.Count != 10 || lanFast.Interval != 100*time.Millisecond || lanFast.Timeout != 2*time.Second {
+		t.Errorf("Unexpected lan_fast settings: %+v", lanFast)
+	}
+	if lanFast.PacketSize != 64 || lanFast.IPProtocol != "ip4" {
+		t.Errorf("lan_fast did not inherit flag defaults: %+v", lanFast)
+	}
+
+	wan := conf.Modules["wan"]
+	if wan.Count != 3 || wan.IPProtocol != "ip6" || !wan.DontFragment {
+		t.Errorf("Unexpected wan settings: %+v", wan)
+	}
+	if len(wan.AllowedOverrides) != 0 {
+		t.Errorf("Expected no allowed overrides for wan, got %v", wan.AllowedOverrides)
+	}
+
+	if _, ok := conf.Modules[defaultModuleName]; !ok {
+		t.Error("Default module missing from loaded config")
+	}
+}
+
+func TestLoadExampleConfig(t *testing.T) {
+	setTestFlagDefaults()
+
+	conf, err := loadConfig("example.yml")
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	for _, name := range []string{"lan_fast", "wan", "wan_ipv6", defaultModuleName} {
+		if _, ok := conf.Modules[name]; !ok {
+			t.Errorf("Module %s missing from example config", name)
+		}
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	setTestFlagDefaults()
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{
+			name:    "unknown field",
+			content: "modules:\n  m:\n    cuont: 3\n",
+			wantErr: "error parsing config file",
+		},
+		{
+			name:    "count above maximum",
+			content: "modules:\n  m:\n    count: 500\n",
+			wantErr: "count must be between 1 and 100",
+		},
+		{
+			name:    "invalid ip protocol",
+			content: "modules:\n  m:\n    ip_protocol: ip5\n",
+			wantErr: "ip_protocol",
+		},
+		{
+			name:    "tcp without port",
+			content: "modules:\n  m:\n    protocol: tcp\n",
+			wantErr: "port must be between 1 and 65535 for protocol tcp",
+		},
+		{
+			name:    "timestamp over ip6",
+			content: "modules:\n  m:\n    mode: timestamp\n    ip_protocol: ip6\n",
+			wantErr: "mode timestamp requires ip_protocol ip4 or auto",
+		},
+		{
+			name:    "pmtu over ip4 with unprivileged sockets",
+			content: "modules:\n  m:\n    mode: pmtu\n    socket_mode: unprivileged\n",
+			wantErr: "mode pmtu requires socket_mode privileged or auto, or ip_protocol ip6",
+		},
+		{
+			name:    "arp over ip6",
+			content: "modules:\n  m:\n    protocol: arp\n    ip_protocol: ip6\n",
+			wantErr: "protocol arp requires ip_protocol ip4 or auto",
+		},
+		{
+			name:    "ndp over ip4",
+			content: "modules:\n  m:\n    protocol: ndp\n",
+			wantErr: "protocol ndp requires ip_protocol ip6 or auto",
+		},
+		{
+			name:    "unknown allowed override",
+			content: "modules:\n  m:\n    allowed_overrides: [target]\n",
+			wantErr: "unknown parameter \"target\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfigFile(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Error("Expected error for missing config file")
+	}
+}
+
+func TestModuleApplyOverrides(t *testing.T) {
+	setTestFlagDefaults()
+
+	module := defaultModule()
+	module.AllowedOverrides = []string{"count", "interval", "packet_timeout"}
+
+	got, errs := module.applyOverrides("test", url.Values{"count": {"7"}, "interval": {"250ms"}, "packet_timeout": {"500ms"}}, false)
+	if len(errs) != 0 {
+		t.Fatalf("applyOverrides() errors = %v", errs)
+	}
+	if got.Count != 7 || got.Interval != 250*time.Millisecond || got.PacketTimeout != 500*time.Millisecond {
+		t.Errorf("Overrides not applied: %+v", got)
+	}
+	if module.Count != 3 {
+		t.Errorf("applyOverrides() modified the original module")
+	}
+
+	_, errs = module.applyOverrides("test", url.Values{"packet_size": {"128"}}, true)
+	if len(errs) != 1 || errs[0].Reason != "override_not_allowed" {
+		t.Errorf("Expected override_not_allowed error, got %v", errs)
+	}
+	for _, name := range []string{"netns", "netns_resolve", "fwmark", "source_interface"} {
+		_, errs = defaultModule().applyOverrides("default", url.Values{name: {"1"}}, false)
+		if len(errs) != 1 || errs[0].Reason != "override_not_allowed" {
+			t.Errorf("Expected override_not_allowed error for %s in the default module, got %v", name, errs)
+		}
+	}
+}
+
+func TestModuleApplyOverridesCombined(t *testing.T) {
+	setTestFlagDefaults()
+
+	tests := []struct {
+		name    string
+		module  func(m *Module)
+		params  url.Values
+		wantErr string
+		// wantLenient is the module setting checked in lenient mode
+		wantLenient func(m Module) bool
+	}{
+		{
+			name:   "dont_fragment with privileged sockets",
+			module: func(m *Module) { m.SocketMode = socketModeUnprivileged },
+			params: url.Values{"dont_fragment": {"true"}, "socket_mode": {"privileged"}},
+		},
+		{
+			name:   "arp with auto sockets",
+			module: func(m *Module) { m.SocketMode = socketModeUnprivileged },
+			params: url.Values{"protocol": {"arp"}, "socket_mode": {"auto"}},
+		},
+		{
+			name:   "pmtu over icmp",
+			module: func(m *Module) { m.Protocol, m.Port = protocolTCP, 443 },
+			params: url.Values{"mode": {"pmtu"}, "protocol": {"icmp"}},
+		},
+		{
+			name:   "echo over ip6",
+			module: func(m *Module) { m.Mode = modeTimestamp },
+			params: url.Values{"ip_protocol": {"ip6"}, "mode": {"echo"}},
+		},
+		{
+			name:   "pmtu over ip6 with unprivileged sockets",
+			params: url.Values{"ip_protocol": {"ip6"}, "mode": {"pmtu"}, "socket_mode": {"unprivileged"}},
+		},
+		{
+			name:        "pmtu with unprivileged sockets",
+			params:      url.Values{"count": {"2"}, "mode": {"pmtu"}, "socket_mode": {"unprivileged"}},
+			wantErr:     `invalid parameters mode="pmtu", socket_mode="unprivileged": mode pmtu requires socket_mode privileged or auto, or ip_protocol ip6`,
+			wantLenient: func(m Module) bool { return m.Mode == modeEcho && m.SocketMode == socketModeAuto && m.Count == 2 },
+		},
+		{
+			name:        "dont_fragment with unprivileged sockets",
+			params:      url.Values{"dont_fragment": {"true"}, "socket_mode": {"unprivileged"}},
+			wantErr:     `invalid parameters dont_fragment="true", socket_mode="unprivileged": dont_fragment requires socket_mode privileged or auto`,
+			wantLenient: func(m Module) bool { return !m.DontFragment && m.SocketMode == socketModeAuto },
+		},
+		{
+			name:        "timestamp over a tcp module",
+			module:      func(m *Module) { m.Protocol, m.Port = protocolTCP, 443 },
+			params:      url.Values{"count": {"5"}, "mode": {"timestamp"}},
+			wantErr:     `invalid parameter mode="timestamp": mode timestamp requires protocol icmp`,
+			wantLenient: func(m Module) bool { return m.Mode == modeEcho && m.Count == 5 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			module := defaultModule()
+			module.SocketMode = socketModeAuto
+			if tt.module != nil {
+				tt.module(&module)
+			}
+			if err := module.validate(); err != nil {
+				t.Fatalf("Invalid test module: %v", err)
+			}
+
+			_, errs := module.applyOverrides("test", tt.params, false)
+			if tt.wantErr == "" {
+				if len(errs) != 0 {
+					t.Errorf("applyOverrides() errors = %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Message != tt.wantErr {
+				t.Errorf("applyOverrides() errors = %v, want %q", errs, tt.wantErr)
+			}
+
+			got, errs := module.applyOverrides("test", tt.params, true)
+			if len(errs) != 0 || !tt.wantLenient(got) {
+				t.Errorf("applyOverrides() in lenient mode = %+v, %v", got, errs)
+			}
+		})
+	}
+}
+
+func TestModuleApplyOverridesInvalid(t *testing.T) {
+	setTestFlagDefaults()
+
+	params := url.Values{
+		"count":       {"500"},
+		"interval":    {"abc"},
+		"packet_size": {"-1"},
+		"ip_protocol": {"ip5"},
+		"ttl":         {"256"},
+
+		"source_interface": {"eth0/../x"},
+		"netns":            {"../../etc/passwd"},
+		"fwmark":           {"0x100000000"},
+		"socket_mode":      {"raw"},
+		"mode":             {"flood"},
+		"max_hops":         {"0"},
+		"protocol":         {"sctp"},
+		"port":             {"ssh"},
+	}
+
+	module := defaultModule()
+	module.AllowedOverrides = append(module.AllowedOverrides, "netns", "fwmark", "source_interface")
+	_, errs := module.applyOverrides("default", params, false)
+	want := map[string]string{
+		"invalid_count":       `invalid parameter count="500": count must be between 1 and 100`,
+		"invalid_interval":    `invalid parameter interval="abc": not a valid duration`,
+		"invalid_packet_size": `invalid parameter packet_size="-1": packet_size must be between 1 and 65507`,
+		"invalid_ip_protocol": `invalid parameter ip_protocol="ip5": ip_protocol must be one of ip4, ip6 or auto`,
+		"invalid_ttl":         `invalid parameter ttl="256": ttl must be between 1 and 255, or 0 for the system default`,
+
+		"invalid_source_interface": `invalid parameter source_interface="eth0/../x": source_interface "eth0/../x" is not a valid interface name`,
+		"invalid_netns":            `invalid parameter netns="../../etc/passwd": netns "../../etc/passwd" must be a namespace name or a /proc/<pid>/ns/net path`,
+		"invalid_fwmark":           `invalid parameter fwmark="0x100000000": not a 32 bit unsigned integer`,
+		"invalid_socket_mode":      `invalid parameter socket_mode="raw": socket_mode must be one of auto, privileged or unprivileged`,
+		"invalid_mode":             `invalid parameter mode="flood": mode must be one of echo, pmtu, traceroute or timestamp`,
+		"invalid_max_hops":         `invalid parameter max_hops="0": max_hops must be between 1 and 255`,
+		"invalid_protocol":         `invalid parameter protocol="sctp": protocol must be one of icmp, tcp, udp, arp or ndp`,
+		"invalid_port":             `invalid parameter port="ssh": not an integer`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Expected %d errors, got %v", len(want), errs)
+	}
+	for _, err := range errs {
+		if want[err.Reason] != err.Message {
+			t.Errorf("Error for %s = %q, want %q", err.Reason, err.Message, want[err.Reason])
+		}
+	}
+
+	got, errs := module.applyOverrides("default", params, true)
+	if len(errs) != 0 {
+		t.Fatalf("Expected no errors in lenient mode, got %v", errs)
+	}
+	if got.Count != 3 || got.Interval != time.Second || got.PacketSize != 64 || got.IPProtocol != "ip4" || got.TTL != 0 {
+		t.Errorf("Lenient mode did not keep module settings: %+v", got)
+	}
+}
+
+func TestSafeConfigReload(t *testing.T) {
+	setTestFlagDefaults()
+
+	filename := writeConfigFile(t, "modules:\n  lan_fast:\n    count: 2\n")
+	sc := &SafeConfig{}
+	if err := sc.ReloadConfig(filename); err != nil {
+		t.Fatalf("ReloadConfig() error = %v", err)
+	}
+	if got := testutil.ToFloat64(configReloadSuccess); got != 1 {
+		t.Errorf("config_last_reload_successful = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(configReloadSeconds); got == 0 {
+		t.Error("config_last_reload_success_timestamp_seconds not set")
+	}
+
+	if err := os.WriteFile(filename, []byte("modules:\n  lan_fast:\n    count: nope\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if err := sc.ReloadConfig(filename); err == nil {
+		t.Fatal("Expected error reloading invalid config")
+	}
+	if got := testutil.ToFloat64(configReloadSuccess); got != 0 {
+		t.Errorf("config_last_reload_successful = %v, want 0", got)
+	}
+	if got := sc.Get().Modules["lan_fast"].Count; got != 2 {
+		t.Errorf("Active config changed after failed reload, count = %d", got)
+	}
+}
+
+func TestParseDSCP(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "0", want: 0},
+		{value: "46", want: 46},
+		{value: "EF", want: 46},
+		{value: "af41", want: 34},
+		{value: "CS6", want: 48},
+		{value: "64", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "AF51", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDSCP(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDSCP(%q) = %d, %v; want %d, error %t", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	m, errs := defaultModule().applyOverrides("default", url.Values{"dscp": {"EF"}}, false)
+	if len(errs) != 0 || m.TOS != 184 {
+		t.Errorf("applyOverrides(dscp=EF) = TOS %d, %v; want 184", m.TOS, errs)
+	}
+
+	params := url.Values{"dscp": {"EF"}, "tos": {"0x20"}}
+	_, errs = defaultModule().applyOverrides("default", params, false)
+	want := `invalid parameters dscp="EF", tos="0x20": dscp and tos are mutually exclusive`
+	if len(errs) != 1 || errs[0].Reason != "invalid_dscp" || errs[0].Message != want {
+		t.Errorf("applyOverrides(dscp=EF&tos=0x20) errors = %v, want %q", errs, want)
+	}
+	m, errs = defaultModule().applyOverrides("default", params, true)
+	if len(errs) != 0 || m.TOS != 0 {
+		t.Errorf("applyOverrides(dscp=EF&tos=0x20) in lenient mode = TOS %d, %v; want 0", m.TOS, errs)
+	}
+}
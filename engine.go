@@ -0,0 +1,620 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// engineKey identifies a shared ICMP socket.
+type engineKey struct {
+	network string // icmp.ListenPacket network, e.g. "udp4" or "ip6:ipv6-icmp"
+	address string // local address the socket is bound to
+	raw     bool   // IPv4 raw socket writing its own IP header (dont_fragment)
+	// timestamps enables kernel send and receive timestamps.
+	timestamps bool
+	// ttl is the IPv4 TTL or IPv6 hop limit, 0 for the system default.
+	ttl int
+	// tos is the IPv4 TOS or IPv6 traffic class.
+	tos int
+	// device is the interface or VRF the socket is bound to.
+	device string
+	// netns is the network namespace the socket is opened in.
+	netns string
+	// mark is the firewall mark (SO_MARK) of outgoing packets.
+	mark uint32
+	// dontFragment stops IPv6 sockets from fragmenting outgoing packets
+	// and from limiting them to the cached path MTU.
+	dontFragment bool
+}
+
+// replyKey identifies the echo reply a probe is waiting for.
+type replyKey struct {
+	id   int
+	seq  int
+	peer string
+}
+
+// icmpReply is an echo or timestamp reply, or an ICMP error quoting a
+// request, handed from the reader goroutine to a probe.
+type icmpReply struct {
+	Seq  int
+	Peer net.IP
+	// Data is the echoed data of an echo reply, or the timestamps of a
+	// timestamp reply.
+	Data     []byte
+	Received time.Time
+	// KernelTimestamp is set when Received was taken by the kernel.
+	KernelTimestamp bool
+	// Err is set when the reply is an ICMP error rather than an echo reply.
+	Err *icmpError
+	// TOS is the IPv4 TOS or IPv6 traffic class of the reply, if HasTOS
+	// is set.
+	TOS    int
+	HasTOS bool
+	// Truncated is set when the reply did not fit the receive buffer.
+	Truncated bool
+}
+
+// packetInfo holds what the socket reports about a received packet besides
+// its content.
+type packetInfo struct {
+	Peer     net.IP
+	Received time.Time
+	// KernelTimestamp is set when Received was taken by the kernel.
+	KernelTimestamp bool
+	TOS             int
+	HasTOS          bool
+	Truncated       bool
+}
+
+// icmpError describes an ICMP error message sent in response to one of our
+// echo requests.
+type icmpError struct {
+	Type   string
+	Code   int
+	Router net.IP // node that sent the error
+	// FragmentationNeeded is set for IPv4 fragmentation needed and IPv6
+	// packet too big errors, along with the next-hop MTU if reported.
+	FragmentationNeeded bool
+	MTU                 int
+}
+
+// isFragmentationNeeded reports whether an ICMP error says the request was
+// too big for the path and could not be fragmented.
+func isFragmentationNeeded(proto, typ, code int) bool {
+	if proto == 58 {
+		return typ == int(ipv6.ICMPTypePacketTooBig)
+	}
+	return typ == int(ipv4.ICMPTypeDestinationUnreachable) && code == 4
+}
+
+// icmpErrorType returns the metric label for ICMP error messages of type
+// typ, or false if typ is not an error quoting the offending datagram.
+func icmpErrorType(proto int, typ int) (string, bool) {
+	if proto == 58 {
+		switch ipv6.ICMPType(typ) {
+		case ipv6.ICMPTypeDestinationUnreachable:
+			return "destination_unreachable", true
+		case ipv6.ICMPTypePacketTooBig:
+			return "packet_too_big", true
+		case ipv6.ICMPTypeTimeExceeded:
+			return "time_exceeded", true
+		case ipv6.ICMPTypeParameterProblem:
+			return "parameter_problem", true
+		}
+		return "", false
+	}
+	switch ipv4.ICMPType(typ) {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		return "destination_unreachable", true
+	case ipv4.ICMPTypeRedirect:
+		return "redirect", true
+	case ipv4.ICMPTypeTimeExceeded:
+		return "time_exceeded", true
+	case ipv4.ICMPTypeParameterProblem:
+		return "parameter_problem", true
+	}
+	return "", false
+}
+
+// icmpEngine owns an ICMP socket shared by all running probes using the
+// same address family, socket type and socket settings. A single reader
+// goroutine receives every reply and passes it to the probe waiting for its
+// (ID, sequence, peer), so concurrent probes no longer read each other's
+// replies. The socket is closed once the last probe using it releases it,
+// so probes with per-request settings do not leave sockets behind.
+type icmpEngine struct {
+	key        engineKey
+	conn       net.PacketConn
+	rawConn    *ipv4.RawConn
+	proto      int
+	privileged bool
+	// id is the echo identifier replies arrive with. Unprivileged sockets
+	// on Linux have it rewritten by the kernel to the socket's local port.
+	id int
+
+	writeMu      sync.Mutex
+	txTimestamps bool
+	txKey        uint32
+
+	mu      sync.Mutex
+	waiters map[replyKey]chan<- icmpReply
+
+	// refs counts the probes using the engine, guarded by enginesMu.
+	refs int
+}
+
+var (
+	enginesMu sync.Mutex
+	engines   = map[engineKey]*icmpEngine{}
+
+	sourceBindErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ping_exporter",
+		Name:      "source_bind_errors_total",
+		Help:      "Number of probes whose sockets could not be bound to the requested source address.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(sourceBindErrors)
+}
+
+// bindError is returned when the kernel refuses to bind a socket to the
+// requested source address.
+type bindError struct {
+	address string
+	err     error
+}
+
+func (e *bindError) Error() string {
+	return fmt.Sprintf("cannot bind to source address %s: %v", e.address, e.err)
+}
+
+func (e *bindError) Unwrap() error {
+	return e.err
+}
+
+// getEngine returns the shared engine for the first socket type in
+// candidates that is already open or can be opened. The caller must release
+// the engine when done with it. If none can be opened, a refused bind is
+// reported in preference to other errors, as it is the one the probe's
+// settings can fix.
+func getEngine(candidates []engineKey, logger *slog.Logger) (*icmpEngine, error) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+
+	for _, key := range candidates {
+		if e, ok := engines[key]; ok {
+			e.refs++
+			return e, nil
+		}
+	}
+
+	err := errors.New("no ICMP socket type available in the configured socket mode")
+	var bindErr *bindError
+	for _, key := range candidates {
+		e, openErr := newICMPEngine(key)
+		if openErr != nil {
+			logger.Debug("Failed to open ICMP socket", "network", key.network, "address", key.address, "err", openErr)
+			if bindErr == nil {
+				err = openErr
+				errors.As(openErr, &bindErr)
+			}
+			continue
+		}
+		logger.Info("Opened shared ICMP socket", "network", key.network, "address", key.address, "privileged", e.privileged)
+		e.refs = 1
+		engines[key] = e
+		go e.readLoop()
+		return e, nil
+	}
+	return nil, err
+}
+
+// engineCandidates returns the socket types to try, in order of preference,
+// for pinging dst with the settings of module, limited to those allowed by
+// the module's socket mode.
+func engineCandidates(dst net.IP, srcIP net.IP, module Module) []engineKey {
+	var candidates []engineKey
+	for _, key := range socketCandidates(dst, srcIP, module) {
+		switch {
+		case module.SocketMode == socketModePrivileged && !isPrivileged(key.network),
+			module.SocketMode == socketModeUnprivileged && isPrivileged(key.network):
+			continue
+		}
+		candidates = append(candidates, key)
+	}
+	return candidates
+}
+
+// isPrivileged reports whether network is a raw socket type.
+func isPrivileged(network string) bool {
+	return network == "ip4:icmp" || network == "ip6:ipv6-icmp"
+}
+
+func socketCandidates(dst net.IP, srcIP net.IP, module Module) []engineKey {
+	if dst.To4() == nil {
+		address := "::"
+		if srcIP != nil {
+			address = srcIP.String()
+		}
+		return []engineKey{
+			{network: "ip6:ipv6-icmp", address: address, timestamps: module.KernelTimestamps, ttl: module.TTL, tos: module.TOS, device: module.SourceInterface, netns: module.NetNS, mark: module.FWMark, dontFragment: module.DontFragment},
+			{network: "udp6", address: address, timestamps: module.KernelTimestamps, ttl: module.TTL, tos: module.TOS, device: module.SourceInterface, netns: module.NetNS, mark: module.FWMark, dontFragment: module.DontFragment},
+		}
+	}
+
+	if module.DontFragment {
+		// Need raw socket for don't fragment
+		address := net.IPv4zero.String()
+		if srcIP != nil {
+			address = srcIP.String()
+		}
+		return []engineKey{{network: "ip4:icmp", address: address, raw: true, timestamps: module.KernelTimestamps, ttl: module.TTL, tos: module.TOS, device: module.SourceInterface, netns: module.NetNS, mark: module.FWMark}}
+	}
+
+	address := net.IPv4zero.String()
+	if srcIP != nil {
+		address = srcIP.String()
+	}
+	if module.Mode == modeTimestamp {
+		// Unprivileged ICMP sockets only send echo requests
+		return []engineKey{{network: "ip4:icmp", address: address, timestamps: module.KernelTimestamps, ttl: module.TTL, tos: module.TOS, device: module.SourceInterface, netns: module.NetNS, mark: module.FWMark}}
+	}
+	// Try unprivileged first (works better in Docker)
+	return []engineKey{
+		{network: "udp4", address: address, timestamps: module.KernelTimestamps, ttl: module.TTL, tos: module.TOS, device: module.SourceInterface, netns: module.NetNS, mark: module.FWMark},
+		{network: "ip4:icmp", address: address, timestamps: module.KernelTimestamps, ttl: module.TTL, tos: module.TOS, device: module.SourceInterface, netns: module.NetNS, mark: module.FWMark},
+	}
+}
+
+func newICMPEngine(key engineKey) (*icmpEngine, error) {
+	e := &icmpEngine{
+		key:        key,
+		proto:      1,
+		privileged: isPrivileged(key.network),
+		id:         icmpID,
+		waiters:    map[replyKey]chan<- icmpReply{},
+	}
+	if key.network == "udp6" || key.network == "ip6:ipv6-icmp" {
+		e.proto = 58
+	}
+
+	conn, txTimestamps, err := listenICMP(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ICMP socket: %w", err)
+	}
+	e.conn = conn
+	e.txTimestamps = txTimestamps
+
+	if key.raw {
+		e.rawConn, err = ipv4.NewRawConn(conn)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create raw connection: %w", err)
+		}
+	}
+	if !e.privileged && runtime.GOOS == "linux" {
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			e.id = addr.Port
+		}
+	}
+	return e, nil
+}
+
+// subscribe registers ch to receive the replies to the echo request with
+// sequence seq sent to dst. It must be called before the request is sent.
+func (e *icmpEngine) subscribe(seq int, dst net.IP, ch chan<- icmpReply) replyKey {
+	key := replyKey{id: e.id, seq: seq, peer: dst.String()}
+	e.mu.Lock()
+	e.waiters[key] = ch
+	e.mu.Unlock()
+	return key
+}
+
+func (e *icmpEngine) unsubscribe(key replyKey) {
+	e.mu.Lock()
+	delete(e.waiters, key)
+	e.mu.Unlock()
+}
+
+// sendEcho sends an echo request and returns the time it was sent. The
+// kernel transmit timestamp is used when available, in which case the
+// returned bool is true. A ttl other than 0 overrides the TTL or hop limit
+// of the socket for this request only.
+func (e *icmpEngine) sendEcho(dst *net.IPAddr, srcIP net.IP, seq, ttl int, payload []byte) (time.Time, bool, error) {
+	requestType := icmp.Type(ipv4.ICMPTypeEcho)
+	if e.proto == 58 {
+		requestType = ipv6.ICMPTypeEchoRequest
+	}
+
+	wm := icmp.Message{
+		Type: requestType,
+		Code: 0,
+		Body: &icmp.Echo{
+			ID:   icmpID,
+			Seq:  seq,
+			Data: payload,
+		},
+	}
+	return e.send(dst, srcIP, ttl, wm)
+}
+
+// sendTimestampRequest sends an ICMP timestamp request (RFC 792) carrying
+// the originate timestamp, in milliseconds since midnight UT, and returns
+// the time it was sent like sendEcho.
+func (e *icmpEngine) sendTimestampRequest(dst *net.IPAddr, srcIP net.IP, seq int, originate uint32) (time.Time, bool, error) {
+	// Identifier, sequence number, and the originate, receive and transmit
+	// timestamps, the last two filled in by the target
+	body := make([]byte, 4+timestampLen)
+	binary.BigEndian.PutUint16(body[0:2], uint16(icmpID))
+	binary.BigEndian.PutUint16(body[2:4], uint16(seq))
+	binary.BigEndian.PutUint32(body[4:8], originate)
+
+	wm := icmp.Message{
+		Type: ipv4.ICMPTypeTimestamp,
+		Code: 0,
+		Body: &icmp.RawBody{Data: body},
+	}
+	return e.send(dst, srcIP, 0, wm)
+}
+
+// send marshals and sends an ICMP request with the given TTL, or the
+// socket's if 0, returning the time it was sent and whether that time is a
+// kernel transmit timestamp.
+func (e *icmpEngine) send(dst *net.IPAddr, srcIP net.IP, ttl int, wm icmp.Message) (time.Time, bool, error) {
+	wb, err := wm.Marshal(nil)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to marshal ICMP packet: %w", err)
+	}
+
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	if ttl != 0 && e.rawConn == nil {
+		// Every write holds writeMu, so the TTL only applies to this
+		// request
+		prev, err := e.swapTTL(ttl)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("failed to set TTL %d: %w", ttl, err)
+		}
+		defer e.swapTTL(prev)
+	}
+
+	start := time.Now()
+	if e.rawConn != nil {
+		// Raw IPv4 with don't fragment
+		if ttl == 0 {
+			ttl = e.key.ttl
+		}
+		if ttl == 0 {
+			ttl = 64
+		}
+		header := &ipv4.Header{
+			Version:  ipv4.Version,
+			Len:      ipv4.HeaderLen,
+			Protocol: 1,
+			TotalLen: ipv4.HeaderLen + len(wb),
+			TOS:      e.key.tos,
+			TTL:      ttl,
+			Dst:      dst.IP,
+			Src:      srcIP,
+			Flags:    ipv4.DontFragment,
+		}
+		err = e.rawConn.WriteTo(header, wb, nil)
+	} else if e.privileged {
+		_, err = e.conn.WriteTo(wb, dst)
+	} else {
+		_, err = e.conn.WriteTo(wb, &net.UDPAddr{IP: dst.IP, Zone: dst.Zone})
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to send ICMP packet: %w", err)
+	}
+	if sent, ok := e.sendTimestamp(); ok {
+		return sent, true, nil
+	}
+	return start, false, nil
+}
+
+// receiveBufferSize fits the largest IPv4 datagram, header included, and
+// the largest IPv6 payload. The socket is shared by all probes, so it must
+// hold replies to any packet_size; the kernel reassembles fragmented
+// replies before they are read.
+const receiveBufferSize = 65535
+
+// readLoop receives packets until the socket fails or is closed, then drops
+// the engine so the next probe opens a fresh socket.
+func (e *icmpEngine) readLoop() {
+	rb := make([]byte, receiveBufferSize)
+	oob := make([]byte, 256)
+	for {
+		n, info, err := e.readPacket(rb, oob)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				continue
+			}
+			e.close()
+			return
+		}
+		e.dispatch(rb[:n], info)
+	}
+}
+
+// dispatch hands an echo or timestamp reply, or an ICMP error quoting a
+// request, to the probe waiting for it. Replies nobody is waiting for, and replies to
+// probes that are not keeping up, are dropped.
+func (e *icmpEngine) dispatch(b []byte, info packetInfo) {
+	if len(b) >= 8 {
+		if name, ok := icmpErrorType(e.proto, int(b[0])); ok {
+			// The quoted datagram follows the 8 byte ICMP error header
+			dst, quoted, ok := parseQuotedDatagram(e.proto, b[8:])
+			if !ok {
+				return
+			}
+			icmpErr := &icmpError{Type: name, Code: int(b[1]), Router: info.Peer}
+			if isFragmentationNeeded(e.proto, int(b[0]), int(b[1])) {
+				icmpErr.FragmentationNeeded = true
+				icmpErr.MTU = fragmentationMTU(e.proto, b)
+			}
+			e.dispatchError(quoted, dst, icmpErr, info)
+			return
+		}
+	}
+
+	rm, err := icmp.ParseMessage(e.proto, b)
+	if err != nil {
+		return
+	}
+	if rm.Type == ipv4.ICMPTypeTimestampReply {
+		e.dispatchTimestampReply(rm, info)
+		return
+	}
+	if rm.Type != ipv4.ICMPTypeEchoReply && rm.Type != ipv6.ICMPTypeEchoReply {
+		return
+	}
+	body, ok := rm.Body.(*icmp.Echo)
+	if !ok {
+		return
+	}
+
+	e.deliver(replyKey{id: body.ID, seq: body.Seq, peer: info.Peer.String()}, icmpReply{
+		Seq:      body.Seq,
+		Peer:     info.Peer,
+		Data:     append([]byte(nil), body.Data...),
+		Received: info.Received,
+		TOS:      info.TOS,
+		HasTOS:   info.HasTOS,
+
+		KernelTimestamp: info.KernelTimestamp,
+		Truncated:       info.Truncated,
+	})
+}
+
+// dispatchTimestampReply hands an ICMP timestamp reply to the probe waiting
+// for it, with the originate, receive and transmit timestamps as Data.
+func (e *icmpEngine) dispatchTimestampReply(rm *icmp.Message, info packetInfo) {
+	body, ok := rm.Body.(*icmp.RawBody)
+	if !ok || len(body.Data) < 4+timestampLen {
+		return
+	}
+	id := int(binary.BigEndian.Uint16(body.Data[0:2]))
+	seq := int(binary.BigEndian.Uint16(body.Data[2:4]))
+
+	e.deliver(replyKey{id: id, seq: seq, peer: info.Peer.String()}, icmpReply{
+		Seq:      seq,
+		Peer:     info.Peer,
+		Data:     append([]byte(nil), body.Data[4:4+timestampLen]...),
+		Received: info.Received,
+		TOS:      info.TOS,
+		HasTOS:   info.HasTOS,
+
+		KernelTimestamp: info.KernelTimestamp,
+	})
+}
+
+// dispatchError hands an ICMP error to the probe waiting for the reply to
+// the echo or timestamp request quoted in it. quoted starts at the request
+// header and dst is the address the request was sent to.
+func (e *icmpEngine) dispatchError(quoted []byte, dst net.IP, icmpErr *icmpError, info packetInfo) {
+	if len(quoted) < 8 {
+		return
+	}
+	switch {
+	case e.proto == 58 && quoted[0] == byte(ipv6.ICMPTypeEchoRequest):
+	case e.proto == 1 && (quoted[0] == byte(ipv4.ICMPTypeEcho) || quoted[0] == byte(ipv4.ICMPTypeTimestamp)):
+	default:
+		return
+	}
+	id := int(binary.BigEndian.Uint16(quoted[4:6]))
+	seq := int(binary.BigEndian.Uint16(quoted[6:8]))
+
+	e.deliver(replyKey{id: id, seq: seq, peer: dst.String()}, icmpReply{
+		Seq:      seq,
+		Peer:     dst,
+		Received: info.Received,
+		Err:      icmpErr,
+
+		KernelTimestamp: info.KernelTimestamp,
+	})
+}
+
+func (e *icmpEngine) deliver(key replyKey, reply icmpReply) {
+	e.mu.Lock()
+	ch, ok := e.waiters[key]
+	e.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- reply:
+	default:
+	}
+}
+
+// fragmentationMTU returns the next-hop MTU of a fragmentation needed
+// (RFC 1191) or packet too big (RFC 4443) message. Routers predating RFC
+// 1191 report 0.
+func fragmentationMTU(proto int, b []byte) int {
+	if proto == 58 {
+		return int(binary.BigEndian.Uint32(b[4:8]))
+	}
+	return int(binary.BigEndian.Uint16(b[6:8]))
+}
+
+// parseQuotedDatagram returns the destination and the ICMP message of the
+// IP datagram quoted in an ICMP error. IPv6 extension headers are not
+// followed, as echo requests are sent without them.
+func parseQuotedDatagram(proto int, b []byte) (net.IP, []byte, bool) {
+	if proto == 58 {
+		if len(b) < ipv6.HeaderLen || b[0]>>4 != ipv6.Version || b[6] != 58 {
+			return nil, nil, false
+		}
+		return net.IP(append([]byte(nil), b[24:40]...)), b[ipv6.HeaderLen:], true
+	}
+	if len(b) < ipv4.HeaderLen || b[0]>>4 != ipv4.Version || b[9] != 1 {
+		return nil, nil, false
+	}
+	hl := int(b[0]&0x0f) << 2
+	if hl < ipv4.HeaderLen || hl > len(b) {
+		return nil, nil, false
+	}
+	return net.IPv4(b[16], b[17], b[18], b[19]), b[hl:], true
+}
+
+// release drops a reference taken by getEngine and closes the socket when
+// no probe uses it any more.
+func (e *icmpEngine) release() {
+	enginesMu.Lock()
+	e.refs--
+	last := e.refs == 0
+	if last && engines[e.key] == e {
+		delete(engines, e.key)
+	}
+	enginesMu.Unlock()
+
+	if last {
+		e.conn.Close()
+	}
+}
+
+func (e *icmpEngine) close() {
+	enginesMu.Lock()
+	if engines[e.key] == e {
+		delete(engines, e.key)
+	}
+	enginesMu.Unlock()
+
+	e.conn.Close()
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func marshalEchoReply(t *testing.T, id, seq int, data []byte) []byte {
+	t.Helper()
+	wm := icmp.Message{
+		Type: ipv4.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: data},
+	}
+	b, err := wm.Marshal(nil)
+	if err != nil {
+		t.Fatalf("Failed to marshal echo reply: %v", err)
+	}
+	return b
+}
+
+// skipWithoutEngine skips the test unless one of candidates can be opened.
+func skipWithoutEngine(t *testing.T, candidates []engineKey, logger *slog.Logger) {
+	t.Helper()
+	e, err := getEngine(candidates, logger)
+	if err != nil {
+		t.Skipf("Cannot open ICMP socket in this environment: %v", err)
+	}
+	e.release()
+}
+
+func TestEngineDispatch(t *testing.T) {
+	e := &icmpEngine{
+		proto:   1,
+		id:      4242,
+		waiters: map[replyKey]chan<- icmpReply{},
+	}
+	peer := net.ParseIP("192.0.2.1")
+	replies := make(chan icmpReply, 4)
+	key := e.subscribe(7, peer, replies)
+
+	received := time.Now()
+	e.dispatch(marshalEchoReply(t, 4242, 7, []byte("hello")), packetInfo{Peer: peer, Received: received})
+	e.dispatch(marshalEchoReply(t, 4242, 8, nil), packetInfo{Peer: peer, Received: received})
+	e.dispatch(marshalEchoReply(t, 1111, 7, nil), packetInfo{Peer: peer, Received: received})
+	e.dispatch(marshalEchoReply(t, 4242, 7, nil), packetInfo{Peer: net.ParseIP("192.0.2.2"), Received: received})
+
+	select {
+	case r := <-replies:
+		if r.Seq != 7 || string(r.Data) != "hello" || !r.Received.Equal(received) {
+			t.Errorf("Unexpected reply: %+v", r)
+		}
+	default:
+		t.Fatal("Matching reply was not dispatched")
+	}
+	if len(replies) != 0 {
+		t.Errorf("Replies for other probes were dispatched: %d extra", len(replies))
+	}
+
+	e.unsubscribe(key)
+	e.dispatch(marshalEchoReply(t, 4242, 7, nil), packetInfo{Peer: peer, Received: received})
+	if len(replies) != 0 {
+		t.Error("Reply dispatched after unsubscribe")
+	}
+}
+
+func TestEngineSharedAcrossProbes(t *testing.T) {
+	logger := promslog.New(&promslog.Config{})
+	candidates := engineCandidates(net.ParseIP("127.0.0.1"), nil, Module{})
+	first, err := getEngine(candidates, logger)
+	if err != nil {
+		t.Skipf("Cannot open ICMP socket in this environment: %v", err)
+	}
+
+	module := Module{Count: 3, Interval: 10 * time.Millisecond, PacketSize: 64, Timeout: 5 * time.Second, PacketTimeout: 2 * time.Second, IPProtocol: "ip4"}
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+
+	var wg sync.WaitGroup
+	results := make([]*PingStats, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+			defer cancel()
+			stats, err := performPing(ctx, dst, module, logger)
+			if err != nil {
+				t.Errorf("performPing() error = %v", err)
+				return
+			}
+			results[i] = stats
+		}(i)
+	}
+	wg.Wait()
+
+	for i, stats := range results {
+		if stats != nil && stats.PacketsReceived != module.Count {
+			t.Errorf("Probe %d received %d of %d replies", i, stats.PacketsReceived, module.Count)
+		}
+	}
+
+	second, err := getEngine(candidates, logger)
+	if err != nil {
+		t.Fatalf("getEngine() error = %v", err)
+	}
+	if first != second {
+		t.Error("Expected probes to share a single ICMP engine")
+	}
+	first.release()
+	second.release()
+
+	enginesMu.Lock()
+	_, open := engines[first.key]
+	enginesMu.Unlock()
+	if open {
+		t.Error("Engine still open after every probe released it")
+	}
+}
+
+func TestEngineClosedAfterProbe(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	skipWithoutEngine(t, engineCandidates(net.ParseIP("127.0.0.1"), nil, Module{}), logger)
+
+	// Every TOS needs its own socket, which must not outlive the probe
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	for tos := 4; tos <= 16; tos += 4 {
+		module := Module{Count: 1, PacketSize: 64, Timeout: 5 * time.Second, PacketTimeout: 200 * time.Millisecond, IPProtocol: "ip4", TOS: tos}
+		ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+		stats, err := performPing(ctx, dst, module, logger)
+		cancel()
+		if err != nil || stats.PacketsReceived != 1 {
+			t.Fatalf("performPing() with tos %d = %+v, %v; want a reply", tos, stats, err)
+		}
+	}
+
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	if len(engines) != 0 {
+		t.Errorf("%d engines still open after the probes finished", len(engines))
+	}
+}
+
+func TestEngineDispatchICMPError(t *testing.T) {
+	e := &icmpEngine{
+		proto:   1,
+		id:      4242,
+		waiters: map[replyKey]chan<- icmpReply{},
+	}
+	dst := net.ParseIP("192.0.2.1")
+	replies := make(chan icmpReply, 4)
+	e.subscribe(7, dst, replies)
+
+	request, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: 4242, Seq: 7, Data: []byte("hello")},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("Failed to marshal echo request: %v", err)
+	}
+	header, err := (&ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(request),
+		TTL:      1,
+		Protocol: 1,
+		Src:      net.ParseIP("192.0.2.2"),
+		Dst:      dst,
+	}).Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal IPv4 header: %v", err)
+	}
+	quoted := append(header, request...)
+
+	router := net.ParseIP("198.51.100.1")
+	unreachable, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: 1,
+		Body: &icmp.DstUnreach{Data: quoted},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("Failed to marshal destination unreachable: %v", err)
+	}
+	e.dispatch(unreachable, packetInfo{Peer: router, Received: time.Now()})
+
+	select {
+	case r := <-replies:
+		if r.Seq != 7 || r.Err == nil || r.Err.Type != "destination_unreachable" || r.Err.Code != 1 || !r.Err.Router.Equal(router) {
+			t.Errorf("Unexpected reply: %+v", r)
+		}
+	default:
+		t.Fatal("ICMP error was not dispatched")
+	}
+
+	fragNeeded, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: 4,
+		Body: &icmp.DstUnreach{Data: quoted},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("Failed to marshal fragmentation needed: %v", err)
+	}
+	binary.BigEndian.PutUint16(fragNeeded[6:8], 1400)
+	e.dispatch(fragNeeded, packetInfo{Peer: router, Received: time.Now()})
+	if r := <-replies; r.Err == nil || !r.Err.FragmentationNeeded || r.Err.MTU != 1400 {
+		t.Errorf("Unexpected reply to fragmentation needed: %+v", r)
+	}
+
+	// Errors quoting other requests are dropped
+	e.dispatchError(request, net.ParseIP("192.0.2.9"), &icmpError{Type: "time_exceeded"}, packetInfo{Received: time.Now()})
+	if len(replies) != 0 {
+		t.Error("ICMP error for another destination was dispatched")
+	}
+}
+
+func marshalEchoRequest(t *testing.T) []byte {
+	t.Helper()
+	b, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: icmpID, Seq: 1, Data: []byte("hello")},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("Failed to marshal echo request: %v", err)
+	}
+	return b
+}
+
+func TestEngineCandidatesSourceIP(t *testing.T) {
+	srcIP := net.ParseIP("192.0.2.2")
+	for _, module := range []Module{{}, {DontFragment: true}} {
+		for _, key := range engineCandidates(net.ParseIP("192.0.2.1"), srcIP, module) {
+			if key.address != "192.0.2.2" {
+				t.Errorf("Candidate %+v for module %+v is not bound to the source IP", key, module)
+			}
+		}
+	}
+	for _, key := range engineCandidates(net.ParseIP("192.0.2.1"), nil, Module{}) {
+		if key.address != "0.0.0.0" {
+			t.Errorf("Candidate %+v without source IP is not bound to the wildcard address", key)
+		}
+	}
+}
+
+func TestEngineCandidatesSocketMode(t *testing.T) {
+	for _, mode := range []string{socketModeAuto, socketModePrivileged, socketModeUnprivileged} {
+		candidates := engineCandidates(net.ParseIP("192.0.2.1"), nil, Module{SocketMode: mode})
+		if len(candidates) == 0 {
+			t.Errorf("No candidates for socket mode %s", mode)
+		}
+		for _, key := range candidates {
+			if mode == socketModePrivileged && !isPrivileged(key.network) ||
+				mode == socketModeUnprivileged && isPrivileged(key.network) {
+				t.Errorf("Candidate %+v does not match socket mode %s", key, mode)
+			}
+		}
+	}
+}
+
+func TestGetEnginePrefersBindError(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	// 203.0.113.0/24 is reserved for documentation and not assigned locally
+	var refused engineKey
+	for _, key := range engineCandidates(net.ParseIP("192.0.2.1"), net.ParseIP("203.0.113.254"), Module{}) {
+		e, err := newICMPEngine(key)
+		if err == nil {
+			e.conn.Close()
+		}
+		var be *bindError
+		if errors.As(err, &be) {
+			refused = key
+			break
+		}
+	}
+	if refused.network == "" {
+		t.Skip("Cannot open ICMP socket in this environment")
+	}
+
+	// A socket type that cannot be opened at all, like a raw socket
+	// without CAP_NET_RAW, must not hide the refused bind
+	unavailable := engineKey{network: "ip4:unavailable", address: "0.0.0.0"}
+	for _, candidates := range [][]engineKey{{refused, unavailable}, {unavailable, refused}} {
+		_, err := getEngine(candidates, logger)
+		var be *bindError
+		if !errors.As(err, &be) {
+			t.Errorf("getEngine(%v) error = %v, want the bind error", candidates, err)
+		}
+	}
+}
+
+func TestEngineSendEchoTTL(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	e, err := getEngine(engineCandidates(dst.IP, nil, Module{}), logger)
+	if err != nil {
+		t.Skipf("Cannot open ICMP socket in this environment: %v", err)
+	}
+	defer e.release()
+
+	socketTTL, err := e.swapTTL(64)
+	if err != nil {
+		t.Fatalf("swapTTL() error = %v", err)
+	}
+	e.swapTTL(socketTTL)
+
+	// The TTL of a single request must not stick to the shared socket
+	if _, _, err := e.sendEcho(dst, nil, int(getICMPSequence()), 3, []byte("hello")); err != nil {
+		t.Fatalf("sendEcho() error = %v", err)
+	}
+	if ttl, err := e.swapTTL(socketTTL); err != nil || ttl != socketTTL {
+		t.Errorf("Socket TTL after sending with TTL 3 = %d, %v; want %d", ttl, err, socketTTL)
+	}
+}
@@ -14,14 +14,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -40,19 +41,30 @@ import (
 )
 
 var (
-	toolkitFlags      = webflag.AddFlags(kingpin.CommandLine, ":9115")
-	defaultCount      = kingpin.Flag("ping.default-count", "Default packet count when not specified.").Default("3").Int()
-	defaultInterval   = kingpin.Flag("ping.default-interval", "Default interval when not specified.").Default("1s").Duration()
-	defaultPacketSize = kingpin.Flag("ping.default-packet-size", "Default packet size when not specified.").Default("64").Int()
-	defaultTimeout    = kingpin.Flag("ping.default-timeout", "Default timeout when not specified.").Default("5s").Duration()
-	maxCount          = kingpin.Flag("ping.max-count", "Maximum allowed packet count.").Default("100").Int()
-	maxPacketSize     = kingpin.Flag("ping.max-packet-size", "Maximum allowed packet size.").Default("65507").Int()
-	externalURL       = kingpin.Flag("web.external-url", "The URL under which Ping exporter is externally reachable.").String()
-	routePrefix       = kingpin.Flag("web.route-prefix", "Prefix for the internal routes of web endpoints.").String()
+	toolkitFlags         = webflag.AddFlags(kingpin.CommandLine, ":9115")
+	configFile           = kingpin.Flag("config.file", "Ping exporter configuration file with probe modules.").String()
+	defaultCount         = kingpin.Flag("ping.default-count", "Default packet count when not specified.").Default("3").Int()
+	defaultInterval      = kingpin.Flag("ping.default-interval", "Default interval when not specified.").Default("1s").Duration()
+	defaultPacketSize    = kingpin.Flag("ping.default-packet-size", "Default packet size when not specified.").Default("64").Int()
+	defaultTimeout       = kingpin.Flag("ping.default-timeout", "Default timeout when not specified.").Default("5s").Duration()
+	defaultPacketTimeout = kingpin.Flag("ping.default-packet-timeout", "Default time to wait for the reply to each packet when not specified.").Default("2s").Duration()
+	maxCount             = kingpin.Flag("ping.max-count", "Maximum allowed packet count.").Default("100").Int()
+	maxPacketSize        = kingpin.Flag("ping.max-packet-size", "Maximum allowed packet size.").Default("65507").Int()
+	socketMode           = kingpin.Flag("ping.socket-mode", "ICMP socket type to use: auto, privileged (raw sockets, needs CAP_NET_RAW) or unprivileged (ICMP datagram sockets, needs net.ipv4.ping_group_range on Linux). Modules can override it.").Default(socketModeAuto).Enum(socketModeAuto, socketModePrivileged, socketModeUnprivileged)
+	lenientParams        = kingpin.Flag("ping.lenient-params", "Ignore invalid probe parameters and use the module settings instead of rejecting the request.").Bool()
+	externalURL          = kingpin.Flag("web.external-url", "The URL under which Ping exporter is externally reachable.").String()
+	routePrefix          = kingpin.Flag("web.route-prefix", "Prefix for the internal routes of web endpoints.").String()
 )
 
+var probeRequestsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "ping_exporter",
+	Name:      "probe_requests_rejected_total",
+	Help:      "Number of probe requests rejected because of invalid parameters, by reason.",
+}, []string{"reason"})
+
 func init() {
 	prometheus.MustRegister(version.NewCollector("ping_exporter"))
+	prometheus.MustRegister(probeRequestsRejected)
 }
 
 func main() {
@@ -75,6 +87,15 @@ func run() int {
 	level.Info(logger).Log("msg", "Starting ping_exporter", "version", commonversion.Info())
 	level.Info(logger).Log("msg", commonversion.BuildContext())
 
+	sc := &SafeConfig{}
+	if err := sc.ReloadConfig(*configFile); err != nil {
+		level.Error(logger).Log("msg", "Error loading config", "err", err)
+		return 1
+	}
+	level.Info(logger).Log("msg", "Loaded config file", "file", *configFile, "modules", len(sc.Get().Modules))
+
+	socketSelfTest(*socketMode, logger)
+
 	// Infer external URL if not provided
 	if *externalURL == "" {
 		hostname, err := os.Hostname()
@@ -99,8 +120,11 @@ func run() int {
 	term := make(chan os.Signal, 1)
 	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
 	// Setup HTTP handlers
-	setupHandlers(promLogger)
+	setupHandlers(sc, promLogger)
 
 	srv := &http.Server{}
 	srvc := make(chan struct{})
@@ -116,6 +140,12 @@ func run() int {
 
 	for {
 		select {
+		case <-hup:
+			if err := sc.ReloadConfig(*configFile); err != nil {
+				level.Error(logger).Log("msg", "Error reloading config", "err", err)
+			} else {
+				level.Info(logger).Log("msg", "Reloaded config file", "file", *configFile)
+			}
 		case <-term:
 			level.Info(logger).Log("msg", "Received SIGTERM, exiting gracefully...")
 			return 0
@@ -125,7 +155,7 @@ func run() int {
 	}
 }
 
-func setupHandlers(logger *slog.Logger) {
+func setupHandlers(sc *SafeConfig, logger *slog.Logger) {
 	// Root redirect
 	if *routePrefix != "/" {
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -146,9 +176,27 @@ func setupHandlers(logger *slog.Logger) {
 		w.Write([]byte("Healthy"))
 	})
 
+	// Readiness endpoint
+	http.HandleFunc(path.Join(*routePrefix, "/-/ready"), readyHandler)
+
+	// Reload endpoint
+	http.HandleFunc(path.Join(*routePrefix, "/-/reload"), func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("This endpoint requires a POST request.\n"))
+			return
+		}
+		if err := sc.ReloadConfig(*configFile); err != nil {
+			logger.Error("Error reloading config", "err", err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Reloaded config file", "file", *configFile)
+	})
+
 	// Probe endpoint
 	http.HandleFunc(path.Join(*routePrefix, "probe"), func(w http.ResponseWriter, r *http.Request) {
-		handleProbe(w, r, logger)
+		handleProbe(w, r, sc.Get(), logger)
 	})
 
 	// Root page
@@ -160,62 +208,50 @@ func setupHandlers(logger *slog.Logger) {
     <h1>Ping Exporter</h1>
     <p><a href="probe?target=1.1.1.1&count=5&interval=1s&packet_size=64">Probe 1.1.1.1 with 5 packets</a></p>
     <p><a href="probe?target=google.com&count=3&debug=true">Debug probe google.com</a></p>
+    <p><a href="probe?target=1.1.1.1&module=default">Probe 1.1.1.1 with the default module</a></p>
     <p><a href="metrics">Metrics</a></p>
     </body>
     </html>`))
 	})
 }
 
-func handleProbe(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+func handleProbe(w http.ResponseWriter, r *http.Request, conf *Config, logger *slog.Logger) {
 	params := r.URL.Query()
 
 	// Get target
 	target := params.Get("target")
 	if target == "" {
-		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		rejectProbe(w, logger, paramError{Reason: "missing_target", Message: "Target parameter is missing"})
 		return
 	}
 
-	// Parse parameters with defaults
-	count := *defaultCount
-	if countStr := params.Get("count"); countStr != "" {
-		if c, err := strconv.Atoi(countStr); err == nil && c > 0 && c <= *maxCount {
-			count = c
-		}
+	// Get module
+	moduleName := params.Get("module")
+	if moduleName == "" {
+		moduleName = defaultModuleName
 	}
-
-	interval := *defaultInterval
-	if intervalStr := params.Get("interval"); intervalStr != "" {
-		if i, err := time.ParseDuration(intervalStr); err == nil && i > 0 {
-			interval = i
-		}
-	}
-
-	packetSize := *defaultPacketSize
-	if sizeStr := params.Get("packet_size"); sizeStr != "" {
-		if s, err := strconv.Atoi(sizeStr); err == nil && s > 0 && s <= *maxPacketSize {
-			packetSize = s
-		}
-	}
-
-	timeout := *defaultTimeout
-	if timeoutStr := params.Get("timeout"); timeoutStr != "" {
-		if t, err := time.ParseDuration(timeoutStr); err == nil && t > 0 {
-			timeout = t
-		}
+	module, ok := conf.Modules[moduleName]
+	if !ok {
+		rejectProbe(w, logger, paramError{Reason: "unknown_module", Message: fmt.Sprintf("Unknown module %q", moduleName)})
+		return
 	}
 
-	ipProtocol := params.Get("ip_protocol")
-	if ipProtocol == "" {
-		ipProtocol = "ip4"
+	// Apply query parameter overrides allowed by the module
+	module, errs := module.applyOverrides(moduleName, params, *lenientParams)
+	if len(errs) > 0 {
+		rejectProbe(w, logger, errs...)
+		return
 	}
 
-	sourceIP := params.Get("source_ip")
-	dontFragment := params.Get("dont_fragment") == "true"
 	debug := params.Get("debug") == "true"
 
-	// Create probe logger
-	probeLogger := logger.With("target", target, "count", count, "interval", interval, "packet_size", packetSize)
+	// Create probe logger. In debug mode its records are also collected
+	// for the response.
+	var probeLogs bytes.Buffer
+	if debug {
+		logger = slog.New(teeHandler{logger.Handler(), slog.NewTextHandler(&probeLogs, &slog.HandlerOptions{Level: slog.LevelDebug})})
+	}
+	probeLogger := logger.With("target", target, "module", moduleName, "count", module.Count, "interval", module.Interval, "packet_size", module.PacketSize)
 
 	// Set log level for this probe if specified
 	if logLevelStr := params.Get("log_level"); logLevelStr != "" {
@@ -227,7 +263,7 @@ func handleProbe(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
 	probeLogger.Info("Beginning probe")
 
 	// Create context with timeout
-	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	ctx, cancel := context.WithTimeout(r.Context(), module.Timeout)
 	defer cancel()
 
 	// Create Prometheus registry for this probe
@@ -235,7 +271,7 @@ func handleProbe(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
 
 	// Run the ping probe
 	start := time.Now()
-	success := probePing(ctx, target, count, interval, packetSize, ipProtocol, sourceIP, dontFragment, registry, probeLogger)
+	success := probePing(ctx, target, module, registry, probeLogger)
 	duration := time.Since(start).Seconds()
 
 	// Create duration metric
@@ -265,12 +301,30 @@ func handleProbe(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
 		w.Header().Set("Content-Type", "text/plain")
 		debugOutput := fmt.Sprintf("Logs for the probe:\n")
 		debugOutput += fmt.Sprintf("Target: %s\n", target)
-		debugOutput += fmt.Sprintf("Count: %d\n", count)
-		debugOutput += fmt.Sprintf("Interval: %s\n", interval)
-		debugOutput += fmt.Sprintf("Packet Size: %d\n", packetSize)
-		debugOutput += fmt.Sprintf("IP Protocol: %s\n", ipProtocol)
+		debugOutput += fmt.Sprintf("Module: %s\n", moduleName)
+		debugOutput += fmt.Sprintf("Protocol: %s\n", module.Protocol)
+		if module.Protocol == protocolTCP || module.Protocol == protocolUDP {
+			debugOutput += fmt.Sprintf("Port: %d\n", module.Port)
+		}
+		debugOutput += fmt.Sprintf("Mode: %s\n", module.Mode)
+		if module.Mode == modeTraceroute {
+			debugOutput += fmt.Sprintf("Max Hops: %d\n", module.MaxHops)
+		}
+		debugOutput += fmt.Sprintf("Count: %d\n", module.Count)
+		debugOutput += fmt.Sprintf("Interval: %s\n", module.Interval)
+		debugOutput += fmt.Sprintf("Packet Size: %d\n", module.PacketSize)
+		debugOutput += fmt.Sprintf("Packet Timeout: %s\n", module.PacketTimeout)
+		debugOutput += fmt.Sprintf("Kernel Timestamps: %t\n", module.KernelTimestamps)
+		debugOutput += fmt.Sprintf("IP Protocol: %s\n", module.IPProtocol)
+		debugOutput += fmt.Sprintf("Socket Mode: %s\n", module.SocketMode)
+		debugOutput += fmt.Sprintf("Source Interface: %s\n", module.SourceInterface)
+		debugOutput += fmt.Sprintf("Network Namespace: %s\n", module.NetNS)
+		debugOutput += fmt.Sprintf("FW Mark: 0x%x\n", module.FWMark)
+		debugOutput += fmt.Sprintf("TTL: %d\n", module.TTL)
+		debugOutput += fmt.Sprintf("TOS: %d\n", module.TOS)
 		debugOutput += fmt.Sprintf("Success: %t\n", success)
 		debugOutput += fmt.Sprintf("Duration: %.3fs\n", duration)
+		debugOutput += "\n" + probeLogs.String()
 		debugOutput += "\n\nMetrics that would have been returned:\n"
 		w.Write([]byte(debugOutput))
 
@@ -284,3 +338,57 @@ func handleProbe(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
 	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	h.ServeHTTP(w, r)
 }
+
+// rejectProbe answers a probe request with 400 Bad Request listing every
+// rejected parameter, and counts the request once for each distinct reason.
+func rejectProbe(w http.ResponseWriter, logger *slog.Logger, errs ...paramError) {
+	messages := make([]string, 0, len(errs))
+	reasons := map[string]bool{}
+	for _, err := range errs {
+		messages = append(messages, err.Message)
+		if !reasons[err.Reason] {
+			reasons[err.Reason] = true
+			probeRequestsRejected.WithLabelValues(err.Reason).Inc()
+		}
+	}
+	logger.Debug("Rejected probe request", "errors", strings.Join(messages, "; "))
+	http.Error(w, strings.Join(messages, "\n"), http.StatusBadRequest)
+}
+
+// teeHandler passes log records to every handler that is enabled for them.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
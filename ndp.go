@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv6"
+)
+
+// NDP option types (RFC 4861)
+const (
+	ndpOptionSourceLinkLayerAddress = 1
+	ndpOptionTargetLinkLayerAddress = 2
+)
+
+// solicitedNodeAddress returns the solicited-node multicast address of ip,
+// which the neighbor solicitations for ip are sent to.
+func solicitedNodeAddress(ip net.IP) net.IP {
+	addr := net.ParseIP("ff02::1:ff00:0")
+	copy(addr[13:], ip.To16()[13:])
+	return addr
+}
+
+// marshalNeighborSolicitation builds a neighbor solicitation for target
+// from a host with link-layer address srcMAC, which may be empty. The
+// kernel fills in the checksum.
+func marshalNeighborSolicitation(target net.IP, srcMAC net.HardwareAddr) []byte {
+	b := make([]byte, 24, 24+8)
+	b[0] = byte(ipv6.ICMPTypeNeighborSolicitation)
+	copy(b[8:24], target.To16())
+	if len(srcMAC) == 6 {
+		b = append(b, ndpOptionSourceLinkLayerAddress, 1)
+		b = append(b, srcMAC...)
+	}
+	return b
+}
+
+// parseNeighborAdvertisement returns the target link-layer address of a
+// solicited neighbor advertisement for target, which is nil if the
+// advertisement carries none.
+func parseNeighborAdvertisement(b []byte, target net.IP) (net.HardwareAddr, bool) {
+	if len(b) < 24 || b[0] != byte(ipv6.ICMPTypeNeighborAdvertisement) || b[1] != 0 {
+		return nil, false
+	}
+	// Unsolicited advertisements answer no request
+	if b[4]&0x40 == 0 || !net.IP(b[8:24]).Equal(target) {
+		return nil, false
+	}
+	for opts := b[24:]; len(opts) >= 8; {
+		length := int(opts[1]) * 8
+		if length == 0 || length > len(opts) {
+			break
+		}
+		if opts[0] == ndpOptionTargetLinkLayerAddress && length == 8 {
+			return net.HardwareAddr(append([]byte(nil), opts[2:8]...)), true
+		}
+		opts = opts[length:]
+	}
+	return nil, true
+}
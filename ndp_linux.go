@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv6"
+)
+
+// ndpPinger multicasts neighbor solicitations for the target on the
+// interface owning its prefix, or named by its zone, and reports the
+// advertisements of every host claiming the address.
+type ndpPinger struct {
+	conn    *ipv6.PacketConn
+	ifindex int
+	dstIP   net.IP
+	request []byte
+	results chan<- transportResult
+	matcher neighborMatcher
+
+	closeOnce sync.Once
+}
+
+func newNDPPinger(dstAddr *net.IPAddr, module Module, results chan<- transportResult) (transportPinger, error) {
+	if dstAddr.IP.To4() != nil {
+		return nil, fmt.Errorf("NDP needs an IPv6 target, not %s", dstAddr.IP)
+	}
+
+	var ifi *net.Interface
+	err := withNetNS(module.NetNS, func() error {
+		var err error
+		ifi, err = ndpInterface(dstAddr, module)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key := engineKey{
+		network: "ip6:ipv6-icmp",
+		address: "::",
+		tos:     module.TOS,
+		device:  ifi.Name,
+		netns:   module.NetNS,
+		mark:    module.FWMark,
+	}
+	if srcIP := net.ParseIP(module.SourceIP); srcIP != nil {
+		key.address = srcIP.String()
+		if srcIP.IsLinkLocalUnicast() {
+			key.address += "%" + ifi.Name
+		}
+	}
+	conn, _, err := listenICMP(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Neighbor discovery messages are sent with, and only accepted with, a
+	// hop limit of 255, which proves they come from the link (RFC 4861)
+	pc := ipv6.NewPacketConn(conn)
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeNeighborAdvertisement)
+	for _, err := range []error{
+		pc.SetMulticastInterface(ifi),
+		pc.SetMulticastHopLimit(255),
+		pc.SetHopLimit(255),
+		pc.SetICMPFilter(&filter),
+		pc.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagInterface, true),
+	} {
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	p := &ndpPinger{
+		conn:    pc,
+		ifindex: ifi.Index,
+		dstIP:   dstAddr.IP,
+		request: marshalNeighborSolicitation(dstAddr.IP, ifi.HardwareAddr),
+		results: results,
+	}
+	go p.readLoop()
+	return p, nil
+}
+
+// ndpInterface returns the interface to send neighbor solicitations for dst
+// from: that of its zone or source_interface if set, or else the interface
+// with an address on the prefix of dst.
+func ndpInterface(dst *net.IPAddr, module Module) (*net.Interface, error) {
+	switch {
+	case dst.Zone != "":
+		if index, err := strconv.Atoi(dst.Zone); err == nil {
+			return net.InterfaceByIndex(index)
+		}
+		ifi, err := net.InterfaceByName(dst.Zone)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q of the target's zone does not exist", dst.Zone)
+		}
+		return ifi, nil
+	case module.SourceInterface != "":
+		ifi, err := net.InterfaceByName(module.SourceInterface)
+		if err != nil {
+			return nil, fmt.Errorf("source interface %q does not exist", module.SourceInterface)
+		}
+		return ifi, nil
+	case dst.IP.IsLinkLocalUnicast():
+		return nil, fmt.Errorf("link-local target %s needs a zone, e.g. %s%%eth0, or source_interface", dst.IP, dst.IP)
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if ok && ipnet.IP.To4() == nil && ipnet.Contains(dst.IP) && !ipnet.IP.Equal(dst.IP) {
+				return &ifi, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s is not on a directly connected prefix", dst.IP)
+}
+
+func (p *ndpPinger) start(index int) (time.Time, error) {
+	// Recorded first, as the advertisement may arrive before WriteTo returns
+	p.matcher.sent(index)
+	sent := time.Now()
+	if _, err := p.conn.WriteTo(p.request, nil, &net.IPAddr{IP: solicitedNodeAddress(p.dstIP)}); err != nil {
+		return time.Time{}, fmt.Errorf("failed to send neighbor solicitation: %w", err)
+	}
+	return sent, nil
+}
+
+// readLoop reports the neighbor advertisements for the target until the
+// socket is closed.
+func (p *ndpPinger) readLoop() {
+	b := make([]byte, 1500)
+	for {
+		n, cm, src, err := p.conn.ReadFrom(b)
+		if err != nil {
+			var errno syscall.Errno
+			if errors.As(err, &errno) {
+				continue
+			}
+			return
+		}
+		received := time.Now()
+		if cm == nil || cm.IfIndex != p.ifindex || cm.HopLimit != 255 {
+			continue
+		}
+		mac, ok := parseNeighborAdvertisement(b[:n], p.dstIP)
+		if !ok {
+			continue
+		}
+
+		// Advertisements must carry the MAC address when answering a
+		// multicast solicitation; the sender identifies those that do not
+		responder := mac.String()
+		if mac == nil {
+			responder = src.String()
+		}
+		index, ok := p.matcher.match(responder)
+		if !ok {
+			continue
+		}
+		select {
+		case p.results <- transportResult{index: index, received: received, responder: responder, withoutMAC: mac == nil}:
+		default:
+		}
+	}
+}
+
+func (p *ndpPinger) close() {
+	p.closeOnce.Do(func() { p.conn.Close() })
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+)
+
+func TestPerformTransportPingNDP(t *testing.T) {
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip command not found")
+	}
+	logger := promslog.New(&promslog.Config{})
+
+	// As in TestPerformTransportPingARP, but both the other end of the veth
+	// pair and the macvlan own fd00::2, and the other end fe80::2 as well.
+	// nodad makes the addresses usable right away.
+	prober, hosts := newTestNetNS(t), newTestNetNS(t)
+	runIP(t, prober, "link", "add", "ndp0", "type", "veth", "peer", "name", "ndp1")
+	runIP(t, prober, "link", "set", "ndp1", "netns", hosts)
+	runIP(t, prober, "addr", "add", "fe80::1/64", "dev", "ndp0", "nodad")
+	runIP(t, prober, "addr", "add", "fd00::1/64", "dev", "ndp0", "nodad")
+	runIP(t, prober, "link", "set", "ndp0", "up")
+	runIP(t, hosts, "link", "add", "mv0", "link", "ndp1", "type", "macvlan", "mode", "bridge")
+	runIP(t, hosts, "addr", "add", "fe80::2/64", "dev", "ndp1", "nodad")
+	runIP(t, hosts, "addr", "add", "fd00::2/64", "dev", "ndp1", "nodad")
+	runIP(t, hosts, "addr", "add", "fd00::2/64", "dev", "mv0", "nodad")
+	runIP(t, hosts, "link", "set", "ndp1", "up")
+	runIP(t, hosts, "link", "set", "mv0", "up")
+
+	tests := []struct {
+		target         *net.IPAddr
+		wantReceived   int
+		wantResponders int
+	}{
+		{target: &net.IPAddr{IP: net.ParseIP("fd00::2")}, wantReceived: 3, wantResponders: 2},
+		{target: &net.IPAddr{IP: net.ParseIP("fe80::2"), Zone: "ndp0"}, wantReceived: 3, wantResponders: 1},
+		{target: &net.IPAddr{IP: net.ParseIP("fd00::4")}, wantReceived: 0, wantResponders: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target.String(), func(t *testing.T) {
+			module := Module{Count: 3, Interval: 10 * time.Millisecond, Timeout: 5 * time.Second, PacketTimeout: 500 * time.Millisecond, IPProtocol: "ip6", Protocol: protocolNDP, NetNS: prober}
+			ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+			defer cancel()
+			stats, err := performTransportPing(ctx, tt.target, module, logger)
+			if err != nil {
+				t.Fatalf("performTransportPing() error = %v", err)
+			}
+			if stats.PacketsSent != module.Count || stats.PacketsReceived != tt.wantReceived {
+				t.Errorf("PacketsSent = %d, PacketsReceived = %d, want %d, %d", stats.PacketsSent, stats.PacketsReceived, module.Count, tt.wantReceived)
+			}
+			if len(stats.NeighborResponders) != tt.wantResponders {
+				t.Errorf("NeighborResponders = %v, want %d responders", stats.NeighborResponders, tt.wantResponders)
+			}
+		})
+	}
+
+	module := Module{Count: 1, Interval: time.Second, Timeout: time.Second, PacketTimeout: time.Second, IPProtocol: "ip6", Protocol: protocolNDP, NetNS: prober}
+	if _, err := performTransportPing(context.Background(), &net.IPAddr{IP: net.ParseIP("fe80::2")}, module, logger); err == nil {
+		t.Error("performTransportPing() succeeded for a link-local target without zone")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// newNDPPinger fails: NDP pings are only supported on Linux.
+func newNDPPinger(dstAddr *net.IPAddr, module Module, results chan<- transportResult) (transportPinger, error) {
+	return nil, errors.New("protocol ndp is only supported on Linux")
+}
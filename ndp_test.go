@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv6"
+)
+
+func TestSolicitedNodeAddress(t *testing.T) {
+	if got := solicitedNodeAddress(net.ParseIP("2001:db8::12:3456")); !got.Equal(net.ParseIP("ff02::1:ff12:3456")) {
+		t.Errorf("solicitedNodeAddress() = %s, want ff02::1:ff12:3456", got)
+	}
+}
+
+func TestParseNeighborAdvertisement(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:02")
+	target := net.ParseIP("2001:db8::2")
+
+	// An advertisement is laid out as a solicitation, with the target
+	// link-layer address option in place of the source one
+	advertisement := func() []byte {
+		b := marshalNeighborSolicitation(target, mac)
+		b[0] = byte(ipv6.ICMPTypeNeighborAdvertisement)
+		b[4] = 0x60 // solicited, override
+		b[24] = ndpOptionTargetLinkLayerAddress
+		return b
+	}
+
+	if got, ok := parseNeighborAdvertisement(advertisement(), target); !ok || got.String() != mac.String() {
+		t.Errorf("parseNeighborAdvertisement() = %v, %v, want %v, true", got, ok, mac)
+	}
+	if got, ok := parseNeighborAdvertisement(advertisement()[:24], target); !ok || got != nil {
+		t.Errorf("parseNeighborAdvertisement() without option = %v, %v, want nil, true", got, ok)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(b []byte) []byte
+	}{
+		{name: "solicitation", modify: func(b []byte) []byte { b[0] = byte(ipv6.ICMPTypeNeighborSolicitation); return b }},
+		{name: "unsolicited", modify: func(b []byte) []byte { b[4] = 0x20; return b }},
+		{name: "other target", modify: func(b []byte) []byte { b[23] = 3; return b }},
+		{name: "short", modify: func(b []byte) []byte { return b[:20] }},
+	}
+	for _, tt := range tests {
+		if _, ok := parseNeighborAdvertisement(tt.modify(advertisement()), target); ok {
+			t.Errorf("%s: parseNeighborAdvertisement() accepted the message", tt.name)
+		}
+	}
+}
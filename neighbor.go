@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// neighborMatcher matches ARP replies and neighbor advertisements to the
+// requests they answer. They do not say which one, so an answer is taken to
+// answer the latest request its responder has not answered yet.
+type neighborMatcher struct {
+	mu sync.Mutex
+	// requests is the number of requests sent so far.
+	requests int
+	// answered holds, by responder, the number of requests up to and
+	// including the last one it answered.
+	answered map[string]int
+}
+
+// sent records that request index was sent.
+func (m *neighborMatcher) sent(index int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if index+1 > m.requests {
+		m.requests = index + 1
+	}
+}
+
+// match returns the index of the request an answer from responder answers,
+// or false if responder already answered the latest request.
+func (m *neighborMatcher) match(responder string) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.answered == nil {
+		m.answered = map[string]int{}
+	}
+	if m.requests == 0 || m.answered[responder] >= m.requests {
+		return 0, false
+	}
+	m.answered[responder] = m.requests
+	return m.requests - 1, true
+}
+
+// registerNeighborMetrics exports the hosts that answered the ARP requests
+// (protocol arp) or neighbor solicitations (protocol ndp) of a probe. Hosts
+// that did not tell their MAC address only count as responders.
+func registerNeighborMetrics(registry *prometheus.Registry, stats *PingStats, protocol string) {
+	requests := "ARP requests"
+	if protocol == protocolNDP {
+		requests = "neighbor solicitations"
+	}
+
+	macInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_ping_" + protocol + "_mac_info",
+		Help: "MAC address of each host that answered the " + requests + " for the target",
+	}, []string{"mac"})
+	for mac := range stats.NeighborResponders {
+		macInfo.WithLabelValues(mac).Set(1)
+	}
+	registry.MustRegister(macInfo)
+
+	responders := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_" + protocol + "_responders",
+		Help: "Number of hosts that answered the " + requests + " for the target; more than 1 means an IP address conflict",
+	})
+	responders.Set(float64(len(stats.NeighborResponders) + len(stats.NeighborRespondersWithoutMAC)))
+	registry.MustRegister(responders)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNeighborMatcher(t *testing.T) {
+	var m neighborMatcher
+	if _, ok := m.match("a"); ok {
+		t.Error("match() before any request = true")
+	}
+
+	m.sent(0)
+	if index, ok := m.match("a"); !ok || index != 0 {
+		t.Errorf("match(a) = %d, %v, want 0, true", index, ok)
+	}
+	if index, ok := m.match("b"); !ok || index != 0 {
+		t.Errorf("match(b) = %d, %v, want 0, true", index, ok)
+	}
+	if _, ok := m.match("a"); ok {
+		t.Error("Duplicate match(a) = true")
+	}
+
+	// b missed request 1; its answer is taken for the latest request
+	m.sent(1)
+	m.sent(2)
+	if index, ok := m.match("b"); !ok || index != 2 {
+		t.Errorf("match(b) = %d, %v, want 2, true", index, ok)
+	}
+}
+
+func TestRegisterNeighborMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registerNeighborMetrics(registry, &PingStats{NeighborResponders: map[string]int{"02:00:00:00:00:01": 3, "02:00:00:00:00:02": 1}}, protocolARP)
+
+	want := `
+# HELP probe_ping_arp_mac_info MAC address of each host that answered the ARP requests for the target
+# TYPE probe_ping_arp_mac_info gauge
+probe_ping_arp_mac_info{mac="02:00:00:00:00:01"} 1
+probe_ping_arp_mac_info{mac="02:00:00:00:00:02"} 1
+# HELP probe_ping_arp_responders Number of hosts that answered the ARP requests for the target; more than 1 means an IP address conflict
+# TYPE probe_ping_arp_responders gauge
+probe_ping_arp_responders 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// Advertisements without a MAC address only count as responders
+	registry = prometheus.NewRegistry()
+	registerNeighborMetrics(registry, &PingStats{
+		NeighborResponders:           map[string]int{"02:00:00:00:00:01": 1},
+		NeighborRespondersWithoutMAC: map[string]int{"fe80::2": 1},
+	}, protocolNDP)
+
+	want = `
+# HELP probe_ping_ndp_mac_info MAC address of each host that answered the neighbor solicitations for the target
+# TYPE probe_ping_ndp_mac_info gauge
+probe_ping_ndp_mac_info{mac="02:00:00:00:00:01"} 1
+# HELP probe_ping_ndp_responders Number of hosts that answered the neighbor solicitations for the target; more than 1 means an IP address conflict
+# TYPE probe_ping_ndp_responders gauge
+probe_ping_ndp_responders 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// netnsDir is where `ip netns` keeps its named network namespaces.
+const netnsDir = "/var/run/netns"
+
+// netnsPath returns the file of the network namespace netns, which is
+// either a name created with `ip netns add` or a path such as
+// /proc/<pid>/ns/net.
+func netnsPath(netns string) string {
+	if strings.HasPrefix(netns, "/") {
+		return netns
+	}
+	return filepath.Join(netnsDir, netns)
+}
+
+// withNetNS runs f in the network namespace netns, or in the current one if
+// netns is empty. Sockets created by f stay in that namespace.
+//
+// f runs on a dedicated, locked OS thread that is never unlocked, so the
+// runtime discards the thread instead of reusing it in the wrong namespace.
+func withNetNS(netns string, f func() error) error {
+	if netns == "" {
+		return f()
+	}
+
+	ns, err := os.Open(netnsPath(netns))
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %q: %w", netns, err)
+	}
+	defer ns.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			errc <- fmt.Errorf("failed to enter network namespace %q: %w", netns, os.NewSyscallError("setns", err))
+			return
+		}
+		errc <- f()
+	}()
+	return <-errc
+}
+
+// netnsResolver returns a resolver sending its DNS queries from inside the
+// network namespace netns. The name servers are still taken from the
+// exporter's own resolv.conf.
+func netnsResolver(netns string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var conn net.Conn
+			err := withNetNS(netns, func() error {
+				var err error
+				conn, err = (&net.Dialer{}).DialContext(ctx, network, address)
+				return err
+			})
+			return conn, err
+		},
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNetNSPath(t *testing.T) {
+	if got := netnsPath("tenant1"); got != "/var/run/netns/tenant1" {
+		t.Errorf("netnsPath(tenant1) = %q", got)
+	}
+	if got := netnsPath("/proc/42/ns/net"); got != "/proc/42/ns/net" {
+		t.Errorf("netnsPath(/proc/42/ns/net) = %q", got)
+	}
+}
+
+// newTestNetNS creates an empty network namespace that lives until the test
+// ends and returns its path.
+func newTestNetNS(t *testing.T) string {
+	t.Helper()
+	pathc := make(chan string)
+	errc := make(chan error)
+	done := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			errc <- err
+			return
+		}
+		pathc <- fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+		<-done
+	}()
+	select {
+	case path := <-pathc:
+		t.Cleanup(func() { close(done) })
+		return path
+	case err := <-errc:
+		t.Skipf("Cannot create network namespace in this environment: %v", err)
+		return ""
+	}
+}
+
+func TestListenICMPNetNS(t *testing.T) {
+	netns := newTestNetNS(t)
+
+	conn, _, err := listenICMP(engineKey{network: "ip4:icmp", address: "0.0.0.0", netns: netns})
+	if err != nil {
+		t.Fatalf("listenICMP() error = %v", err)
+	}
+	defer conn.Close()
+
+	// The new namespace has no routes, not even to the loopback address
+	_, err = conn.WriteTo(marshalEchoRequest(t), &net.IPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err == nil {
+		t.Error("Socket was not opened in the network namespace")
+	}
+
+	_, _, err = listenICMP(engineKey{network: "ip4:icmp", address: "0.0.0.0", netns: "doesnotexist"})
+	if err == nil {
+		t.Error("listenICMP() succeeded for a missing namespace")
+	}
+}
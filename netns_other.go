@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// withNetNS runs f. Network namespaces are only supported on Linux.
+func withNetNS(netns string, f func() error) error {
+	if netns != "" {
+		return errors.New("netns is only supported on Linux")
+	}
+	return f()
+}
+
+func netnsResolver(netns string) *net.Resolver {
+	return net.DefaultResolver
+}
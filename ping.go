@@ -1,21 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
 	"math/rand"
 	"net"
 	"os"
-	"runtime"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
-	"golang.org/x/net/ipv6"
 )
 
 var (
@@ -57,23 +58,113 @@ type PingStats struct {
 	MaxRTT          time.Duration
 	AvgRTT          time.Duration
 	StdDevRTT       time.Duration
+	// KernelSendTimestamps and KernelReceiveTimestamps count the RTT
+	// samples whose send and receive times came from the kernel rather
+	// than from userspace.
+	KernelSendTimestamps    int
+	KernelReceiveTimestamps int
+	// PacketsCorrupted counts replies whose echoed data did not match the
+	// request, such as replies with a foreign nonce. PacketsTruncated
+	// counts replies that carried only part of the echoed data, or did
+	// not fit the receive buffer.
+	PacketsCorrupted int
+	PacketsTruncated int
+	// PacketsDuplicate counts additional replies to an already answered
+	// request; PacketsReordered counts replies that arrived after the
+	// reply to a later request.
+	PacketsDuplicate int
+	PacketsReordered int
+	// ICMPErrors holds the ICMP errors received in response to the
+	// probe's echo requests.
+	ICMPErrors []icmpError
+	// PacketsTTLExceeded counts requests that ran out of TTL or hop
+	// limit before reaching the target.
+	PacketsTTLExceeded int
+	// PacketsFragmentationNeeded counts requests too big for the path
+	// that could not be fragmented, reported by a router or refused by the
+	// local stack. NextHopMTU is the smallest next-hop MTU the routers
+	// reported, or 0 if none did.
+	PacketsFragmentationNeeded int
+	NextHopMTU                 int
+	// ReplyTOS counts the echo replies by the IPv4 TOS or IPv6 traffic
+	// class they arrived with, where the platform reports it.
+	ReplyTOS map[int]int
+	// TCPResets counts the TCP handshakes answered with a reset, which
+	// shows the target is reachable although the port is closed.
+	TCPResets int
+	// UDPPortUnreachable counts the UDP datagrams answered with an ICMP
+	// port unreachable error, which also shows the target is reachable.
+	UDPPortUnreachable int
+	// NeighborResponders counts the ARP replies or neighbor advertisements
+	// by MAC address of the host that sent them; more than one responder
+	// means an IP address conflict. NeighborRespondersWithoutMAC counts
+	// the neighbor advertisements that carried no MAC address by the IPv6
+	// address that sent them.
+	NeighborResponders           map[string]int
+	NeighborRespondersWithoutMAC map[string]int
+	// OneWayDelays holds the one-way delay estimates of the timestamp
+	// replies that carried standard timestamps.
+	OneWayDelays []oneWayDelay
 }
 
-func probePing(ctx context.Context, target string, count int, interval time.Duration, packetSize int, ipProtocol, sourceIP string, dontFragment bool, registry *prometheus.Registry, logger *slog.Logger) bool {
+// Protocols of the echoes a probe sends.
+const (
+	protocolICMP = "icmp" // ICMP echo requests
+	protocolTCP  = "tcp"  // TCP handshakes
+	protocolUDP  = "udp"  // UDP datagrams
+	protocolARP  = "arp"  // ARP requests
+	protocolNDP  = "ndp"  // NDP neighbor solicitations
+)
+
+// Probe modes select what a probe measures.
+const (
+	modeEcho       = "echo"       // round-trip times and loss of echo requests
+	modePMTU       = "pmtu"       // path MTU
+	modeTraceroute = "traceroute" // route and per-hop RTT and loss
+	modeTimestamp  = "timestamp"  // one-way delays and clock offset from ICMP timestamps
+)
+
+func probePing(ctx context.Context, target string, module Module, registry *prometheus.Registry, logger *slog.Logger) bool {
 	// Resolve target address
 	var network string
-	switch ipProtocol {
+	switch module.IPProtocol {
 	case "ip4":
 		network = "ip4"
 	case "ip6":
 		network = "ip6"
 	case "auto":
 		network = "ip" // Let Go decide
+		// An explicit source address decides the address family
+		if ip := net.ParseIP(module.SourceIP); ip != nil {
+			if ip.To4() != nil {
+				network = "ip4"
+			} else {
+				network = "ip6"
+			}
+		}
 	default:
+		logger.Error("Unsupported IP protocol", "ip_protocol", module.IPProtocol)
+		return false
+	}
+	// ARP and NDP only work with addresses of their own family
+	switch module.Protocol {
+	case protocolARP:
+		network = "ip4"
+	case protocolNDP:
+		network = "ip6"
+	}
+	// ICMPv6 has no timestamp messages
+	if module.Mode == modeTimestamp {
 		network = "ip4"
 	}
 
-	dstAddr, err := resolveTarget(target, network)
+	var dstAddr *net.IPAddr
+	var err error
+	if module.NetNS != "" && module.NetNSResolve {
+		dstAddr, err = resolveTargetWith(ctx, netnsResolver(module.NetNS), target, network)
+	} else {
+		dstAddr, err = resolveTarget(target, network)
+	}
 	if err != nil {
 		logger.Error("Failed to resolve target", "err", err)
 		return false
@@ -81,8 +172,21 @@ func probePing(ctx context.Context, target string, count int, interval time.Dura
 
 	logger.Info("Target resolved", "target", target, "ip", dstAddr.String())
 
+	switch module.Mode {
+	case modePMTU:
+		return probePMTU(ctx, dstAddr, module, registry, logger)
+	case modeTraceroute:
+		return probeTraceroute(ctx, dstAddr, module, registry, logger)
+	}
+
 	// Perform ping
-	stats, err := performPing(ctx, dstAddr, sourceIP, count, interval, packetSize, dontFragment, logger)
+	var stats *PingStats
+	switch module.Protocol {
+	case protocolTCP, protocolUDP, protocolARP, protocolNDP:
+		stats, err = performTransportPing(ctx, dstAddr, module, logger)
+	default:
+		stats, err = performPing(ctx, dstAddr, module, logger)
+	}
 	if err != nil {
 		logger.Error("Ping failed", "err", err)
 		return false
@@ -90,6 +194,17 @@ func probePing(ctx context.Context, target string, count int, interval time.Dura
 
 	// Register metrics
 	registerPingMetrics(registry, stats)
+	switch module.Protocol {
+	case protocolTCP:
+		registerTCPMetrics(registry, stats)
+	case protocolUDP:
+		registerUDPMetrics(registry, stats)
+	case protocolARP, protocolNDP:
+		registerNeighborMetrics(registry, stats, module.Protocol)
+	}
+	if module.Mode == modeTimestamp {
+		registerTimestampMetrics(registry, stats)
+	}
 
 	return stats.PacketsReceived > 0
 }
@@ -98,295 +213,411 @@ func resolveTarget(target, network string) (*net.IPAddr, error) {
 	return net.ResolveIPAddr(network, target)
 }
 
-func performPing(ctx context.Context, dstAddr *net.IPAddr, sourceIP string, count int, interval time.Duration, packetSize int, dontFragment bool, logger *slog.Logger) (*PingStats, error) {
-	stats := &PingStats{
-		RTTs: make([]time.Duration, 0, count),
-	}
-
-	var (
-		requestType icmp.Type
-		replyType   icmp.Type
-		conn        *icmp.PacketConn
-		v4RawConn   *ipv4.RawConn
-	)
-
-	// Determine ICMP types and create connection
-	var srcIP net.IP
-	if sourceIP != "" {
-		srcIP = net.ParseIP(sourceIP)
-		if srcIP == nil {
-			return nil, fmt.Errorf("invalid source IP: %s", sourceIP)
-		}
+// resolveTargetWith resolves target like resolveTarget, but using resolver.
+func resolveTargetWith(ctx context.Context, resolver *net.Resolver, target, network string) (*net.IPAddr, error) {
+	addrs, err := resolver.LookupIPAddr(ctx, target)
+	if err != nil {
+		return nil, err
 	}
-
-	if dstAddr.IP.To4() == nil {
-		// IPv6
-		requestType = ipv6.ICMPTypeEchoRequest
-		replyType = ipv6.ICMPTypeEchoReply
-		if srcIP == nil {
-			srcIP = net.ParseIP("::")
-		}
-
-		var err error
-		conn, err = icmp.ListenPacket("ip6:ipv6-icmp", srcIP.String())
-		if err != nil {
-			// Try unprivileged
-			conn, err = icmp.ListenPacket("udp6", srcIP.String())
-			if err != nil {
-				return nil, fmt.Errorf("failed to create IPv6 ICMP socket: %w", err)
-			}
-		}
-	} else {
-		// IPv4
-		requestType = ipv4.ICMPTypeEcho
-		replyType = ipv4.ICMPTypeEchoReply
-		if srcIP == nil {
-			srcIP = net.IPv4zero
-		}
-
-		var err error
-		if dontFragment {
-			// Need raw socket for don't fragment
-			netConn, err := net.ListenPacket("ip4:icmp", srcIP.String())
-			if err != nil {
-				return nil, fmt.Errorf("failed to create raw IPv4 ICMP socket: %w", err)
-			}
-			defer netConn.Close()
-
-			v4RawConn, err = ipv4.NewRawConn(netConn)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create raw connection: %w", err)
-			}
-		} else {
-			// Try unprivileged first (works better in Docker)
-			conn, err = icmp.ListenPacket("udp4", "0.0.0.0")
-			if err != nil {
-				logger.Debug("Failed to create unprivileged IPv4 ICMP socket, trying privileged", "err", err)
-				// Try privileged
-				conn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
-				if err != nil {
-					return nil, fmt.Errorf("failed to create IPv4 ICMP socket: %w", err)
-				}
-				logger.Info("Using privileged IPv4 ICMP socket")
-			} else {
-				logger.Info("Using unprivileged IPv4 ICMP socket")
-			}
+	for _, addr := range addrs {
+		is4 := addr.IP.To4() != nil
+		if network == "ip" || (network == "ip4" && is4) || (network == "ip6" && !is4) {
+			return &addr, nil
 		}
 	}
+	return nil, &net.AddrError{Err: "no suitable address found", Addr: target}
+}
 
-	if conn != nil {
-		defer conn.Close()
+func performPing(ctx context.Context, dstAddr *net.IPAddr, module Module, logger *slog.Logger) (*PingStats, error) {
+	count := module.Count
+	session, err := newEchoSession(dstAddr, module, logger)
+	if err != nil {
+		return nil, err
 	}
+	defer session.close()
+	stats := session.stats
 
-	// Create payload
-	payload := make([]byte, packetSize)
-	copy(payload, "Prometheus Ping Exporter")
+	// Send pings on a fixed schedule and match replies as they arrive, so
+	// neither slow nor lost replies delay the packets that follow.
+	sendTimer := time.NewTimer(0)
+	defer sendTimer.Stop()
+	lossTimer := time.NewTimer(0)
+	defer lossTimer.Stop()
 
-	// Send pings
-	for i := 0; i < count; i++ {
-		select {
-		case <-ctx.Done():
-			return stats, ctx.Err()
-		default:
+	start := time.Now()
+	for stats.PacketsSent < count || len(session.pending) > 0 {
+		var sendC <-chan time.Time
+		if stats.PacketsSent < count {
+			sendC = sendTimer.C
 		}
-
-		stats.PacketsSent++
-		seq := getICMPSequence()
-
-		logger.Info("Sending ping packet", "seq", seq, "packet", i+1, "of", count)
-
-		// Create a timeout context for this individual ping
-		pingCtx, cancel := context.WithTimeout(ctx, time.Second*2)
-		rtt, err := sendPing(pingCtx, conn, v4RawConn, dstAddr, srcIP, requestType, replyType, seq, payload, dontFragment, logger)
-		cancel()
-
-		if err != nil {
-			logger.Error("Ping failed", "seq", seq, "err", err)
-		} else {
-			stats.PacketsReceived++
-			stats.RTTs = append(stats.RTTs, rtt)
-			logger.Info("Ping successful", "seq", seq, "rtt", rtt)
+		var lossC <-chan time.Time
+		if deadline, ok := session.nextDeadline(); ok {
+			lossTimer.Reset(time.Until(deadline))
+			lossC = lossTimer.C
 		}
 
-		// Wait for interval (except for last packet)
-		if i < count-1 {
-			select {
-			case <-ctx.Done():
-				return stats, ctx.Err()
-			case <-time.After(interval):
+		select {
+		case <-ctx.Done():
+			// The probe deadline cuts the wait for outstanding replies
+			// short; those packets count as lost.
+			logger.Info("Probe deadline reached", "sent", stats.PacketsSent, "outstanding", len(session.pending), "err", ctx.Err())
+			session.drain()
+			calculateStats(stats)
+			return stats, nil
+		case <-sendC:
+			logger.Info("Sending ping packet", "packet", stats.PacketsSent+1, "of", count)
+			session.send()
+			if stats.PacketsSent < count {
+				sendTimer.Reset(time.Until(start.Add(time.Duration(stats.PacketsSent) * module.Interval)))
 			}
+		case reply := <-session.replies:
+			session.receive(reply)
+		case now := <-lossC:
+			session.expire(now)
 		}
 	}
 
+	// Duplicates of the last replies may still be on their way, so keep
+	// listening until the last packet would have timed out
+	session.linger(ctx)
+
 	// Calculate statistics
 	calculateStats(stats)
 
 	return stats, nil
 }
 
-func sendPing(ctx context.Context, conn *icmp.PacketConn, v4RawConn *ipv4.RawConn, dstAddr *net.IPAddr, srcIP net.IP, requestType, replyType icmp.Type, seq uint16, payload []byte, dontFragment bool, logger *slog.Logger) (time.Duration, error) {
-	// Create ICMP message
-	body := &icmp.Echo{
-		ID:   icmpID,
-		Seq:  int(seq),
-		Data: payload,
+// newEchoSession checks the source settings of module and returns a session
+// for sending echo requests to dstAddr on a shared engine.
+func newEchoSession(dstAddr *net.IPAddr, module Module, logger *slog.Logger) (*echoSession, error) {
+	var srcIP net.IP
+	if module.SourceIP != "" {
+		srcIP = net.ParseIP(module.SourceIP)
+		if srcIP == nil {
+			return nil, fmt.Errorf("invalid source IP: %s", module.SourceIP)
+		}
+		if (srcIP.To4() == nil) != (dstAddr.IP.To4() == nil) {
+			return nil, fmt.Errorf("source IP %s and target %s are not of the same address family", srcIP, dstAddr.IP)
+		}
 	}
 
-	logger.Debug("Creating ICMP packet", "id", icmpID, "seq", seq, "payload_size", len(payload))
-
-	wm := icmp.Message{
-		Type: requestType,
-		Code: 0,
-		Body: body,
+	// Interfaces in another namespace are checked when binding to them
+	if module.SourceInterface != "" && module.NetNS == "" {
+		if _, err := net.InterfaceByName(module.SourceInterface); err != nil {
+			return nil, fmt.Errorf("source interface %q does not exist", module.SourceInterface)
+		}
 	}
 
-	wb, err := wm.Marshal(nil)
+	engine, err := getEngine(engineCandidates(dstAddr.IP, srcIP, module), logger)
 	if err != nil {
-		return 0, fmt.Errorf("failed to marshal ICMP packet: %w", err)
+		var be *bindError
+		if errors.As(err, &be) {
+			sourceBindErrors.Inc()
+		}
+		return nil, err
 	}
+	logger.Debug("Using shared ICMP socket", "network", engine.key.network, "privileged", engine.privileged)
+
+	return &echoSession{
+		engine:    engine,
+		dst:       dstAddr,
+		srcIP:     srcIP,
+		nonce:     rand.Uint64(),
+		size:      module.PacketSize,
+		timeout:   module.PacketTimeout,
+		timestamp: module.Mode == modeTimestamp,
+		// Leave room for duplicates
+		replies:  make(chan icmpReply, 2*module.Count),
+		pending:  map[int]*outstandingPacket{},
+		answered: map[int]*outstandingPacket{},
+		stats: &PingStats{
+			RTTs: make([]time.Duration, 0, module.Count),
+		},
+		logger: logger,
+	}, nil
+}
 
-	logger.Debug("ICMP packet marshaled", "size", len(wb))
-
-	var dst net.Addr = dstAddr
-	privileged := conn == nil
+// payloadHeaderLen is the size of the nonce and send timestamp at the start
+// of every echo payload.
+const payloadHeaderLen = 16
+
+// newPayload builds an echo payload of size bytes carrying the probe's nonce
+// and the send time. Payloads shorter than payloadHeaderLen carry as much of
+// the header as fits.
+func newPayload(size int, nonce uint64, sent time.Time) []byte {
+	var header [payloadHeaderLen]byte
+	binary.BigEndian.PutUint64(header[:8], nonce)
+	binary.BigEndian.PutUint64(header[8:], uint64(sent.UnixNano()))
+
+	payload := make([]byte, size)
+	n := copy(payload, header[:])
+	copy(payload[n:], "Prometheus Ping Exporter")
+	return payload
+}
 
-	if !privileged {
-		dst = &net.UDPAddr{IP: dstAddr.IP, Zone: dstAddr.Zone}
-	}
+// outstandingPacket is an echo request still waiting for its reply.
+type outstandingPacket struct {
+	index      int // position in the probe's send order
+	payload    []byte
+	sent       time.Time
+	kernelSent bool
+	deadline   time.Time
+}
 
-	// Send packet and record time
-	start := time.Now()
+// echoSession tracks the echo requests of a single probe on a shared engine.
+type echoSession struct {
+	engine  *icmpEngine
+	dst     *net.IPAddr
+	srcIP   net.IP
+	nonce   uint64
+	size    int
+	timeout time.Duration
+	// timestamp makes the session send timestamp requests instead of echo
+	// requests.
+	timestamp bool
+	// ttl, if not 0, overrides the TTL or hop limit of the shared socket
+	// for the session's echo requests.
+	ttl     int
+	replies chan icmpReply
+	keys    []replyKey
+	pending map[int]*outstandingPacket
+	// answered holds the requests already replied to, so that further
+	// replies can be recognised as duplicates.
+	answered map[int]*outstandingPacket
+	// lastIndex is the highest send index replied to so far.
+	lastIndex int
+	// lastDeadline is the deadline of the last request sent.
+	lastDeadline time.Time
+	// responders, if not nil, collects the RTTs by responding address and
+	// makes TTL exceeded errors count as replies from the router that
+	// sent them, as traceroute needs.
+	responders map[string][]time.Duration
+	stats      *PingStats
+	logger     *slog.Logger
+}
 
-	if v4RawConn != nil {
-		// Raw IPv4 with don't fragment
-		header := &ipv4.Header{
-			Version:  ipv4.Version,
-			Len:      ipv4.HeaderLen,
-			Protocol: 1,
-			TotalLen: ipv4.HeaderLen + len(wb),
-			TTL:      64,
-			Dst:      dstAddr.IP,
-			Src:      srcIP,
-			Flags:    ipv4.DontFragment,
-		}
-		err = v4RawConn.WriteTo(header, wb, nil)
+// send transmits the next echo request. A request that cannot be sent is
+// counted as lost.
+func (s *echoSession) send() {
+	seq := int(getICMPSequence())
+	s.stats.PacketsSent++
+	s.keys = append(s.keys, s.engine.subscribe(seq, s.dst.IP, s.replies))
+
+	var payload []byte
+	var sent time.Time
+	var kernel bool
+	var err error
+	if s.timestamp {
+		// The target echoes the originate timestamp
+		originate := millisecondsSinceMidnight(time.Now())
+		payload = binary.BigEndian.AppendUint32(nil, originate)
+		sent, kernel, err = s.engine.sendTimestampRequest(s.dst, s.srcIP, seq, originate)
 	} else {
-		_, err = conn.WriteTo(wb, dst)
+		payload = newPayload(s.size, s.nonce, time.Now())
+		sent, kernel, err = s.engine.sendEcho(s.dst, s.srcIP, seq, s.ttl, payload)
+	}
+	if errors.Is(err, syscall.EMSGSIZE) {
+		// Larger than the MTU of the outgoing interface, or than the path
+		// MTU the kernel already learned, and not allowed to fragment
+		s.stats.PacketsFragmentationNeeded++
 	}
-
 	if err != nil {
-		return 0, fmt.Errorf("failed to send ICMP packet: %w", err)
+		s.logger.Error("Ping failed", "seq", seq, "err", err)
+		return
 	}
-
-	logger.Debug("ICMP packet sent", "dst", dst.String())
-
-	// Wait for reply
-	return waitForReply(ctx, conn, v4RawConn, dst, replyType, body.ID, body.Seq, wb, privileged, start, logger)
+	s.lastDeadline = sent.Add(s.timeout)
+	s.pending[seq] = &outstandingPacket{index: s.stats.PacketsSent, payload: payload, sent: sent, kernelSent: kernel, deadline: s.lastDeadline}
 }
 
-func waitForReply(ctx context.Context, conn *icmp.PacketConn, v4RawConn *ipv4.RawConn, dst net.Addr, replyType icmp.Type, expectedID, expectedSeq int, expectedData []byte, privileged bool, sendTime time.Time, logger *slog.Logger) (time.Duration, error) {
-	var dstAddr *net.IPAddr
-	if ipAddr, ok := dst.(*net.IPAddr); ok {
-		dstAddr = ipAddr
-	} else if udpAddr, ok := dst.(*net.UDPAddr); ok {
-		dstAddr = &net.IPAddr{IP: udpAddr.IP, Zone: udpAddr.Zone}
-	}
-	rb := make([]byte, 1500)
-	deadline, _ := ctx.Deadline()
-
-	if conn != nil {
-		err := conn.SetReadDeadline(deadline)
-		if err != nil {
-			return 0, fmt.Errorf("failed to set read deadline: %w", err)
-		}
-	} else if v4RawConn != nil {
-		err := v4RawConn.SetReadDeadline(deadline)
-		if err != nil {
-			return 0, fmt.Errorf("failed to set read deadline: %w", err)
-		}
+func (s *echoSession) receive(reply icmpReply) {
+	if reply.Err != nil {
+		s.receiveError(reply)
+		return
 	}
 
-	for {
-		var n int
-		var peer net.Addr
-		var err error
-
-		if v4RawConn != nil {
-			var h *ipv4.Header
-			var p []byte
-			h, p, _, err = v4RawConn.ReadFrom(rb)
-			if err == nil {
-				copy(rb, p)
-				n = len(p)
-				peer = &net.IPAddr{IP: h.Src}
-			}
-		} else {
-			n, peer, err = conn.ReadFrom(rb)
+	p, ok := s.pending[reply.Seq]
+	duplicate := false
+	if !ok {
+		if p, duplicate = s.answered[reply.Seq]; !duplicate {
+			// Reply to a packet that already timed out
+			s.logger.Debug("Ignoring late ICMP reply", "seq", reply.Seq)
+			return
 		}
+	}
+	if s.timestamp {
+		s.receiveTimestamp(reply, p, duplicate)
+		return
+	}
+	if reply.Truncated || len(reply.Data) < len(p.payload) && bytes.HasPrefix(p.payload, reply.Data) {
+		s.stats.PacketsTruncated++
+		s.logger.Warn("Ignoring truncated ICMP reply", "seq", reply.Seq, "size", len(reply.Data), "expected_size", len(p.payload))
+		return
+	}
+	if !bytes.Equal(reply.Data, p.payload) {
+		// Spoofed, stale or damaged replies do not end the wait for the
+		// genuine one.
+		s.stats.PacketsCorrupted++
+		s.logger.Warn("Ignoring corrupted ICMP reply", "seq", reply.Seq, "size", len(reply.Data), "expected_size", len(p.payload))
+		return
+	}
+	if duplicate {
+		s.stats.PacketsDuplicate++
+		s.logger.Warn("Duplicate ICMP reply", "seq", reply.Seq)
+		return
+	}
 
-		receiveTime := time.Now()
+	// The send time in the payload only authenticates the reply; the RTT
+	// starts from the monotonic time taken when the request was written
+	s.answer(reply, p, p.sent, reply.Peer)
+}
 
-		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-				logger.Debug("Timeout waiting for ICMP reply")
-				return 0, fmt.Errorf("timeout waiting for ICMP reply")
-			}
-			logger.Debug("Failed to read ICMP reply", "err", err)
-			return 0, fmt.Errorf("failed to read ICMP reply: %w", err)
-		}
+// answer records reply, sent by responder, as the answer to the outstanding
+// request p.
+func (s *echoSession) answer(reply icmpReply, p *outstandingPacket, sent time.Time, responder net.IP) {
+	delete(s.pending, reply.Seq)
+	s.answered[reply.Seq] = p
 
-		logger.Debug("Received packet", "from", peer.String(), "size", n, "expected_from", dst.String())
+	if p.index < s.lastIndex {
+		s.stats.PacketsReordered++
+		s.logger.Info("Reordered ICMP reply", "seq", reply.Seq)
+	} else {
+		s.lastIndex = p.index
+	}
 
-		// Check if this is from our target
-		if peer.String() != dst.String() {
-			logger.Debug("Packet from unexpected source", "from", peer.String(), "expected", dst.String())
-			continue
+	rtt := reply.Received.Sub(sent)
+	s.stats.PacketsReceived++
+	s.stats.RTTs = append(s.stats.RTTs, rtt)
+	if s.responders != nil {
+		s.responders[responder.String()] = append(s.responders[responder.String()], rtt)
+	}
+	if reply.HasTOS {
+		if s.stats.ReplyTOS == nil {
+			s.stats.ReplyTOS = map[int]int{}
 		}
+		s.stats.ReplyTOS[reply.TOS]++
+	}
+	if p.kernelSent {
+		s.stats.KernelSendTimestamps++
+	}
+	if reply.KernelTimestamp {
+		s.stats.KernelReceiveTimestamps++
+	}
+	s.logger.Info("Ping successful", "seq", reply.Seq, "responder", responder, "rtt", rtt, "kernel_send_timestamp", p.kernelSent, "kernel_receive_timestamp", reply.KernelTimestamp)
+}
 
-		// Parse ICMP message
-		var rm *icmp.Message
-		var parseErr error
-		if dstAddr != nil && dstAddr.IP.To4() == nil {
-			// IPv6 - protocol 58
-			rm, parseErr = icmp.ParseMessage(58, rb[:n])
-		} else {
-			// IPv4 - protocol 1
-			rm, parseErr = icmp.ParseMessage(1, rb[:n])
+// receiveError records an ICMP error reported for an echo request. Errors
+// other than redirects mean no reply is coming, so the packet is given up
+// on right away.
+func (s *echoSession) receiveError(reply icmpReply) {
+	p, ok := s.pending[reply.Seq]
+	if !ok {
+		s.logger.Debug("Ignoring ICMP error for a request that is no longer outstanding", "seq", reply.Seq, "type", reply.Err.Type)
+		return
+	}
+	if s.responders != nil && reply.Err.Type == "time_exceeded" && reply.Err.Code == 0 {
+		// The router the request expired at is the hop being traced
+		s.stats.PacketsTTLExceeded++
+		s.answer(reply, p, p.sent, reply.Err.Router)
+		return
+	}
+	s.stats.ICMPErrors = append(s.stats.ICMPErrors, *reply.Err)
+	s.logger.Warn("ICMP error received", "seq", reply.Seq, "type", reply.Err.Type, "code", reply.Err.Code, "router", reply.Err.Router)
+	switch reply.Err.Type {
+	case "redirect":
+		// The router still forwards the request
+		return
+	case "time_exceeded":
+		if reply.Err.Code == 0 {
+			s.stats.PacketsTTLExceeded++
 		}
-		if parseErr != nil {
-			logger.Debug("Failed to parse ICMP message", "err", parseErr)
-			continue
+	}
+	if reply.Err.FragmentationNeeded {
+		s.stats.PacketsFragmentationNeeded++
+		if mtu := reply.Err.MTU; mtu > 0 && (s.stats.NextHopMTU == 0 || mtu < s.stats.NextHopMTU) {
+			s.stats.NextHopMTU = mtu
 		}
+	}
+	delete(s.pending, reply.Seq)
+}
 
-		logger.Debug("Parsed ICMP message", "type", rm.Type, "expected_type", replyType)
-
-		if rm.Type != replyType {
-			logger.Debug("Wrong ICMP message type", "got", rm.Type, "expected", replyType)
-			continue
+// expire gives up on every packet whose reply is overdue at now.
+func (s *echoSession) expire(now time.Time) {
+	for seq, p := range s.pending {
+		if !now.Before(p.deadline) {
+			delete(s.pending, seq)
+			s.logger.Error("Ping failed", "seq", seq, "err", "timeout waiting for ICMP reply")
 		}
+	}
+}
 
-		body, ok := rm.Body.(*icmp.Echo)
+// wait processes replies until no request is outstanding or ctx is done.
+func (s *echoSession) wait(ctx context.Context) error {
+	lossTimer := time.NewTimer(0)
+	defer lossTimer.Stop()
+	for {
+		deadline, ok := s.nextDeadline()
 		if !ok {
-			logger.Debug("ICMP message body is not Echo")
-			continue
+			return nil
+		}
+		lossTimer.Reset(time.Until(deadline))
+		select {
+		case <-ctx.Done():
+			s.drain()
+			return ctx.Err()
+		case reply := <-s.replies:
+			s.receive(reply)
+		case now := <-lossTimer.C:
+			s.expire(now)
 		}
+	}
+}
 
-		logger.Debug("Received ICMP Echo", "id", body.ID, "seq", body.Seq, "expected_id", expectedID, "expected_seq", expectedSeq)
+// linger processes replies, which by now can only be duplicates, until the
+// last request sent times out or ctx is done.
+func (s *echoSession) linger(ctx context.Context) {
+	timer := time.NewTimer(time.Until(s.lastDeadline))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.drain()
+			return
+		case reply := <-s.replies:
+			s.receive(reply)
+		case <-timer.C:
+			s.drain()
+			return
+		}
+	}
+}
 
-		// Check if this is our packet
-		if (!privileged && runtime.GOOS == "linux") || body.ID == expectedID {
-			if body.Seq == expectedSeq {
-				// Calculate RTT properly
-				rtt := receiveTime.Sub(sendTime)
-				logger.Debug("Found matching ICMP reply", "rtt", rtt)
-				return rtt, nil
-			} else {
-				logger.Debug("Wrong sequence number", "got", body.Seq, "expected", expectedSeq)
-			}
-		} else {
-			logger.Debug("Wrong ICMP ID", "got", body.ID, "expected", expectedID)
+// drain processes the replies already queued for the session.
+func (s *echoSession) drain() {
+	for {
+		select {
+		case reply := <-s.replies:
+			s.receive(reply)
+		default:
+			return
+		}
+	}
+}
+
+func (s *echoSession) nextDeadline() (time.Time, bool) {
+	var next time.Time
+	for _, p := range s.pending {
+		if next.IsZero() || p.deadline.Before(next) {
+			next = p.deadline
 		}
 	}
+	return next, !next.IsZero()
+}
+
+func (s *echoSession) close() {
+	for _, key := range s.keys {
+		s.engine.unsubscribe(key)
+	}
+	s.engine.release()
 }
 
 func calculateStats(stats *PingStats) {
@@ -446,6 +677,83 @@ func registerPingMetrics(registry *prometheus.Registry, stats *PingStats) {
 	packetsReceived.Set(float64(stats.PacketsReceived))
 	registry.MustRegister(packetsReceived)
 
+	// Corrupted replies
+	packetsCorrupted := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_packets_corrupted",
+		Help: "Number of ICMP replies whose echoed data did not match the request",
+	})
+	packetsCorrupted.Set(float64(stats.PacketsCorrupted))
+	registry.MustRegister(packetsCorrupted)
+
+	// Duplicate replies
+	packetsDuplicate := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_packets_duplicate",
+		Help: "Number of duplicate ICMP replies",
+	})
+	packetsDuplicate.Set(float64(stats.PacketsDuplicate))
+	registry.MustRegister(packetsDuplicate)
+
+	// Reordered replies
+	packetsReordered := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_packets_reordered",
+		Help: "Number of ICMP replies received after the reply to a later request",
+	})
+	packetsReordered.Set(float64(stats.PacketsReordered))
+	registry.MustRegister(packetsReordered)
+
+	// Requests that did not reach the target within the TTL
+	packetsTTLExceeded := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_packets_ttl_exceeded",
+		Help: "Number of ICMP packets that exceeded their TTL or hop limit before reaching the target",
+	})
+	packetsTTLExceeded.Set(float64(stats.PacketsTTLExceeded))
+	registry.MustRegister(packetsTTLExceeded)
+
+	packetsTruncated := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_packets_truncated",
+		Help: "Number of ICMP replies that carried only part of the echoed data",
+	})
+	packetsTruncated.Set(float64(stats.PacketsTruncated))
+	registry.MustRegister(packetsTruncated)
+
+	// Packets too big for the path, to test jumbo frame paths with
+	// dont_fragment
+	packetsFragmentationNeeded := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_packets_fragmentation_needed",
+		Help: "Number of ICMP packets that exceeded the path MTU and could not be fragmented",
+	})
+	packetsFragmentationNeeded.Set(float64(stats.PacketsFragmentationNeeded))
+	registry.MustRegister(packetsFragmentationNeeded)
+
+	if stats.NextHopMTU > 0 {
+		nextHopMTU := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_ping_next_hop_mtu_bytes",
+			Help: "Smallest next-hop MTU reported by fragmentation needed or packet too big errors",
+		})
+		nextHopMTU.Set(float64(stats.NextHopMTU))
+		registry.MustRegister(nextHopMTU)
+	}
+
+	// TOS of the replies, to detect remarking in the path
+	replyTOS := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_ping_reply_tos_packets",
+		Help: "Number of ICMP replies received with each IPv4 TOS or IPv6 traffic class value",
+	}, []string{"tos"})
+	for tos, n := range stats.ReplyTOS {
+		replyTOS.WithLabelValues(strconv.Itoa(tos)).Set(float64(n))
+	}
+	registry.MustRegister(replyTOS)
+
+	// ICMP errors by type and code
+	icmpErrors := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_ping_icmp_errors",
+		Help: "Number of ICMP errors received in response to echo requests, by ICMP type and code",
+	}, []string{"type", "code"})
+	for _, e := range stats.ICMPErrors {
+		icmpErrors.WithLabelValues(e.Type, strconv.Itoa(e.Code)).Inc()
+	}
+	registry.MustRegister(icmpErrors)
+
 	// Packet loss ratio
 	packetLoss := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "probe_ping_packet_loss_ratio",
@@ -454,6 +762,17 @@ func registerPingMetrics(registry *prometheus.Registry, stats *PingStats) {
 	packetLoss.Set(stats.PacketLoss)
 	registry.MustRegister(packetLoss)
 
+	// Timestamp sources of the RTT samples
+	timestamps := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_ping_timestamps",
+		Help: "Number of RTT samples by the source of their send and receive timestamps",
+	}, []string{"direction", "source"})
+	timestamps.WithLabelValues("send", "kernel").Set(float64(stats.KernelSendTimestamps))
+	timestamps.WithLabelValues("send", "userspace").Set(float64(len(stats.RTTs) - stats.KernelSendTimestamps))
+	timestamps.WithLabelValues("receive", "kernel").Set(float64(stats.KernelReceiveTimestamps))
+	timestamps.WithLabelValues("receive", "userspace").Set(float64(len(stats.RTTs) - stats.KernelReceiveTimestamps))
+	registry.MustRegister(timestamps)
+
 	// RTT statistics
 	if len(stats.RTTs) > 0 {
 		rttGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
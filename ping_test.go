@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/promslog"
 )
 
@@ -169,6 +174,9 @@ func TestRegisterPingMetrics(t *testing.T) {
 		"probe_ping_packets_sent":      false,
 		"probe_ping_packets_received":  false,
 		"probe_ping_packet_loss_ratio": false,
+		"probe_ping_packets_corrupted": false,
+		"probe_ping_packets_duplicate": false,
+		"probe_ping_packets_reordered": false,
 		"probe_ping_rtt_seconds":       false,
 	}
 
@@ -194,7 +202,7 @@ func TestProbePingTimeout(t *testing.T) {
 	defer cancel()
 
 	// Use an unreachable IP to ensure timeout
-	success := probePing(ctx, "192.0.2.1", 1, 100*time.Millisecond, 64, "ip4", "", false, registry, logger)
+	success := probePing(ctx, "203.0.113.1", Module{Count: 1, Interval: 100 * time.Millisecond, PacketSize: 64, Timeout: time.Second, PacketTimeout: time.Second, IPProtocol: "ip4"}, registry, logger)
 
 	if success {
 		t.Error("Expected ping to fail due to timeout, but it succeeded")
@@ -208,7 +216,7 @@ func TestProbePingLocalhost(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	success := probePing(ctx, "127.0.0.1", 1, 100*time.Millisecond, 64, "ip4", "", false, registry, logger)
+	success := probePing(ctx, "127.0.0.1", Module{Count: 1, Interval: 100 * time.Millisecond, PacketSize: 64, Timeout: time.Second, PacketTimeout: time.Second, IPProtocol: "ip4"}, registry, logger)
 
 	// Note: This test may fail in some environments where ICMP is blocked
 	// In those cases, the test should still complete without error
@@ -234,7 +242,7 @@ func TestProbePingInvalidTarget(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	success := probePing(ctx, "invalid.nonexistent.domain.test", 1, 100*time.Millisecond, 64, "ip4", "", false, registry, logger)
+	success := probePing(ctx, "invalid.nonexistent.domain.test", Module{Count: 1, Interval: 100 * time.Millisecond, PacketSize: 64, Timeout: time.Second, PacketTimeout: time.Second, IPProtocol: "ip4"}, registry, logger)
 
 	if success {
 		t.Error("Expected ping to fail for invalid target, but it succeeded")
@@ -359,3 +367,335 @@ func TestPingStatsEdgeCases(t *testing.T) {
 		})
 	}
 }
+
+func TestPerformPingPipelined(t *testing.T) {
+	logger := promslog.New(&promslog.Config{})
+	skipWithoutEngine(t, engineCandidates(net.ParseIP("203.0.113.1"), nil, Module{}), logger)
+
+	// Replies to a documentation address never arrive. Lost packets must
+	// not delay the ones after them, so the probe should take roughly
+	// (count-1)*interval plus one packet timeout.
+	module := Module{Count: 4, Interval: 100 * time.Millisecond, PacketSize: 64, Timeout: 10 * time.Second, PacketTimeout: 2 * time.Second, IPProtocol: "ip4"}
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	stats, err := performPing(ctx, &net.IPAddr{IP: net.ParseIP("203.0.113.1")}, module, logger)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("performPing() error = %v", err)
+	}
+
+	if stats.PacketsSent != module.Count {
+		t.Errorf("PacketsSent = %d, want %d", stats.PacketsSent, module.Count)
+	}
+	if elapsed > 3*time.Second {
+		t.Errorf("Probe took %v, lost packets delayed the schedule", elapsed)
+	}
+}
+
+func TestPerformPingInterval(t *testing.T) {
+	logger := promslog.New(&promslog.Config{})
+	skipWithoutEngine(t, engineCandidates(net.ParseIP("127.0.0.1"), nil, Module{}), logger)
+
+	module := Module{Count: 5, Interval: 50 * time.Millisecond, PacketSize: 64, Timeout: 5 * time.Second, PacketTimeout: 100 * time.Millisecond, IPProtocol: "ip4"}
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	stats, err := performPing(ctx, &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, module, logger)
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("performPing() error = %v", err)
+	}
+
+	if stats.PacketsReceived != module.Count {
+		t.Errorf("PacketsReceived = %d, want %d", stats.PacketsReceived, module.Count)
+	}
+	// Packets go out at 0, 50, ..., 200ms regardless of the RTT, and the
+	// probe listens for duplicates until the last one times out
+	if elapsed < 300*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("Probe took %v, want about 300ms", elapsed)
+	}
+}
+
+func TestPerformPingDeadlineKeepsPartialStats(t *testing.T) {
+	logger := promslog.New(&promslog.Config{})
+	skipWithoutEngine(t, engineCandidates(net.ParseIP("127.0.0.1"), nil, Module{}), logger)
+
+	tests := []struct {
+		name         string
+		target       string
+		wantReceived bool
+	}{
+		{name: "replies received before deadline", target: "127.0.0.1", wantReceived: true},
+		{name: "replies outstanding at deadline", target: "203.0.113.1", wantReceived: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			module := Module{Count: 5, Interval: 100 * time.Millisecond, PacketSize: 64, Timeout: 250 * time.Millisecond, PacketTimeout: 2 * time.Second, IPProtocol: "ip4"}
+			ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+			defer cancel()
+
+			stats, err := performPing(ctx, &net.IPAddr{IP: net.ParseIP(tt.target)}, module, logger)
+			if err != nil {
+				t.Fatalf("performPing() error = %v", err)
+			}
+			if stats.PacketsSent != 3 {
+				t.Errorf("PacketsSent = %d, want 3", stats.PacketsSent)
+			}
+			if tt.wantReceived && stats.PacketsReceived != stats.PacketsSent {
+				t.Errorf("PacketsReceived = %d, want %d", stats.PacketsReceived, stats.PacketsSent)
+			}
+			if !tt.wantReceived && stats.PacketLoss != 1.0 {
+				t.Errorf("PacketLoss = %v, want 1", stats.PacketLoss)
+			}
+		})
+	}
+}
+
+func TestPayload(t *testing.T) {
+	sent := time.Unix(1700000000, 123456789)
+	payload := newPayload(64, 0xdeadbeef, sent)
+	if len(payload) != 64 {
+		t.Fatalf("len(payload) = %d, want 64", len(payload))
+	}
+	nonce := binary.BigEndian.Uint64(payload[:8])
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(payload[8:payloadHeaderLen])))
+	if nonce != 0xdeadbeef || !ts.Equal(sent) {
+		t.Errorf("Payload carries nonce %x and send time %v, want deadbeef and %v", nonce, ts, sent)
+	}
+
+	short := newPayload(4, 0xdeadbeef, sent)
+	if len(short) != 4 || binary.BigEndian.Uint32(short) != 0 {
+		t.Errorf("Short payload = %x, want the first 4 bytes of the nonce", short)
+	}
+}
+
+func TestEchoSessionRTTFromSendTime(t *testing.T) {
+	sent := time.Now()
+	// The wall clock stepped back an hour between the payload being built
+	// and the request being written
+	payload := newPayload(64, 42, sent.Add(-time.Hour))
+	stats := &PingStats{PacketsSent: 1}
+	s := &echoSession{
+		pending:  map[int]*outstandingPacket{7: {index: 1, payload: payload, sent: sent, deadline: sent.Add(time.Second)}},
+		answered: map[int]*outstandingPacket{},
+		stats:    stats,
+		logger:   promslog.NewNopLogger(),
+	}
+	s.receive(icmpReply{Seq: 7, Data: payload, Received: sent.Add(3 * time.Millisecond)})
+	if len(stats.RTTs) != 1 || stats.RTTs[0] != 3*time.Millisecond {
+		t.Errorf("RTTs = %v, want [3ms] measured from the send time", stats.RTTs)
+	}
+}
+
+func TestEchoSessionCorruptedReply(t *testing.T) {
+	sent := time.Now()
+	payload := newPayload(64, 42, sent)
+	stats := &PingStats{PacketsSent: 1}
+	s := &echoSession{
+		pending:  map[int]*outstandingPacket{7: {index: 1, payload: payload, sent: sent, deadline: sent.Add(time.Second)}},
+		answered: map[int]*outstandingPacket{},
+		stats:    stats,
+		logger:   promslog.NewNopLogger(),
+	}
+
+	corrupted := append([]byte(nil), payload...)
+	corrupted[20] ^= 0xff
+	replies := []icmpReply{
+		{Seq: 7, Data: corrupted, Received: sent.Add(time.Millisecond)},
+		{Seq: 7, Data: payload[:32], Received: sent.Add(time.Millisecond)},
+		{Seq: 7, Data: newPayload(64, 43, sent), Received: sent.Add(time.Millisecond)},
+		{Seq: 7, Data: payload, Received: sent.Add(time.Millisecond), Truncated: true},
+	}
+	for _, r := range replies {
+		s.receive(r)
+	}
+	if stats.PacketsCorrupted != 2 || stats.PacketsTruncated != 2 || stats.PacketsReceived != 0 {
+		t.Fatalf("PacketsCorrupted = %d, PacketsTruncated = %d, PacketsReceived = %d; want 2, 2, 0", stats.PacketsCorrupted, stats.PacketsTruncated, stats.PacketsReceived)
+	}
+	if _, ok := s.pending[7]; !ok {
+		t.Fatal("Corrupted reply ended the wait for the genuine one")
+	}
+
+	s.receive(icmpReply{Seq: 7, Data: payload, Received: sent.Add(5 * time.Millisecond)})
+	if stats.PacketsReceived != 1 || len(stats.RTTs) != 1 || stats.RTTs[0] != 5*time.Millisecond {
+		t.Errorf("PacketsReceived = %d, RTTs = %v; want 1, [5ms]", stats.PacketsReceived, stats.RTTs)
+	}
+}
+
+func TestEchoSessionDuplicateAndReordered(t *testing.T) {
+	sent := time.Now()
+	stats := &PingStats{PacketsSent: 3}
+	s := &echoSession{
+		pending:  map[int]*outstandingPacket{},
+		answered: map[int]*outstandingPacket{},
+		stats:    stats,
+		logger:   promslog.NewNopLogger(),
+	}
+	payloads := map[int][]byte{}
+	for i, seq := range []int{10, 11, 12} {
+		payloads[seq] = newPayload(32, 42, sent)
+		s.pending[seq] = &outstandingPacket{index: i + 1, payload: payloads[seq], sent: sent, deadline: sent.Add(time.Second)}
+	}
+
+	received := sent.Add(time.Millisecond)
+	for _, seq := range []int{10, 12, 12, 11, 10} {
+		s.receive(icmpReply{Seq: seq, Data: payloads[seq], Received: received})
+	}
+
+	if stats.PacketsReceived != 3 {
+		t.Errorf("PacketsReceived = %d, want 3", stats.PacketsReceived)
+	}
+	if stats.PacketsDuplicate != 2 {
+		t.Errorf("PacketsDuplicate = %d, want 2", stats.PacketsDuplicate)
+	}
+	if stats.PacketsReordered != 1 {
+		t.Errorf("PacketsReordered = %d, want 1", stats.PacketsReordered)
+	}
+}
+
+func TestEchoSessionLingerLateDuplicate(t *testing.T) {
+	sent := time.Now()
+	payload := newPayload(32, 42, sent)
+	stats := &PingStats{PacketsSent: 1}
+	s := &echoSession{
+		replies:      make(chan icmpReply, 2),
+		pending:      map[int]*outstandingPacket{},
+		answered:     map[int]*outstandingPacket{},
+		lastDeadline: sent.Add(200 * time.Millisecond),
+		stats:        stats,
+		logger:       promslog.NewNopLogger(),
+	}
+	s.pending[10] = &outstandingPacket{index: 1, payload: payload, sent: sent, deadline: s.lastDeadline}
+	s.receive(icmpReply{Seq: 10, Data: payload, Received: sent.Add(time.Millisecond)})
+
+	// The duplicate arrives after the last request was answered
+	time.AfterFunc(50*time.Millisecond, func() {
+		s.replies <- icmpReply{Seq: 10, Data: payload, Received: time.Now()}
+	})
+	s.linger(context.Background())
+	if stats.PacketsReceived != 1 || stats.PacketsDuplicate != 1 {
+		t.Errorf("PacketsReceived = %d, PacketsDuplicate = %d; want 1, 1", stats.PacketsReceived, stats.PacketsDuplicate)
+	}
+	if elapsed := time.Since(sent); elapsed < 200*time.Millisecond {
+		t.Errorf("linger() returned after %v, before the last request timed out", elapsed)
+	}
+}
+
+func TestEchoSessionICMPError(t *testing.T) {
+	sent := time.Now()
+	stats := &PingStats{PacketsSent: 2}
+	s := &echoSession{
+		pending: map[int]*outstandingPacket{
+			1: {index: 1, payload: newPayload(32, 42, sent), sent: sent, deadline: sent.Add(time.Second)},
+			2: {index: 2, payload: newPayload(32, 42, sent), sent: sent, deadline: sent.Add(time.Second)},
+		},
+		answered: map[int]*outstandingPacket{},
+		stats:    stats,
+		logger:   promslog.NewNopLogger(),
+	}
+	router := net.ParseIP("198.51.100.1")
+
+	s.receive(icmpReply{Seq: 1, Err: &icmpError{Type: "redirect", Code: 1, Router: router}})
+	if _, ok := s.pending[1]; !ok {
+		t.Error("Redirect ended the wait for the reply")
+	}
+	s.receive(icmpReply{Seq: 2, Err: &icmpError{Type: "destination_unreachable", Code: 1, Router: router}})
+	if _, ok := s.pending[2]; ok {
+		t.Error("Destination unreachable did not end the wait for the reply")
+	}
+	s.receive(icmpReply{Seq: 3, Err: &icmpError{Type: "destination_unreachable", Code: 1, Router: router}})
+
+	if len(stats.ICMPErrors) != 2 {
+		t.Fatalf("ICMPErrors = %v, want 2 errors", stats.ICMPErrors)
+	}
+
+	registry := prometheus.NewRegistry()
+	calculateStats(stats)
+	registerPingMetrics(registry, stats)
+	expected := `
+# HELP probe_ping_icmp_errors Number of ICMP errors received in response to echo requests, by ICMP type and code
+# TYPE probe_ping_icmp_errors gauge
+probe_ping_icmp_errors{code="1",type="destination_unreachable"} 1
+probe_ping_icmp_errors{code="1",type="redirect"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "probe_ping_icmp_errors"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEchoSessionTTLExceeded(t *testing.T) {
+	sent := time.Now()
+	stats := &PingStats{PacketsSent: 1}
+	s := &echoSession{
+		pending:  map[int]*outstandingPacket{1: {index: 1, payload: newPayload(32, 42, sent), sent: sent, deadline: sent.Add(time.Second)}},
+		answered: map[int]*outstandingPacket{},
+		stats:    stats,
+		logger:   promslog.NewNopLogger(),
+	}
+
+	s.receive(icmpReply{Seq: 1, Err: &icmpError{Type: "time_exceeded", Code: 0, Router: net.ParseIP("198.51.100.1")}})
+	if stats.PacketsTTLExceeded != 1 {
+		t.Errorf("PacketsTTLExceeded = %d, want 1", stats.PacketsTTLExceeded)
+	}
+	if len(s.pending) != 0 {
+		t.Error("TTL exceeded did not end the wait for the reply")
+	}
+}
+
+func TestEchoSessionFragmentationNeeded(t *testing.T) {
+	sent := time.Now()
+	stats := &PingStats{PacketsSent: 2}
+	s := &echoSession{
+		pending: map[int]*outstandingPacket{
+			1: {index: 1, payload: newPayload(32, 42, sent), sent: sent, deadline: sent.Add(time.Second)},
+			2: {index: 2, payload: newPayload(32, 42, sent), sent: sent, deadline: sent.Add(time.Second)},
+		},
+		answered: map[int]*outstandingPacket{},
+		stats:    stats,
+		logger:   promslog.NewNopLogger(),
+	}
+
+	s.receive(icmpReply{Seq: 1, Err: &icmpError{Type: "destination_unreachable", Code: 4, FragmentationNeeded: true, MTU: 1400}})
+	s.receive(icmpReply{Seq: 2, Err: &icmpError{Type: "destination_unreachable", Code: 4, FragmentationNeeded: true, MTU: 1280}})
+	if stats.PacketsFragmentationNeeded != 2 || stats.NextHopMTU != 1280 {
+		t.Errorf("PacketsFragmentationNeeded = %d, NextHopMTU = %d; want 2, 1280", stats.PacketsFragmentationNeeded, stats.NextHopMTU)
+	}
+	if len(s.pending) != 0 {
+		t.Error("Fragmentation needed did not end the wait for the reply")
+	}
+}
+
+func TestPerformPingUnknownSourceInterface(t *testing.T) {
+	module := Module{Count: 1, Interval: time.Second, PacketSize: 64, Timeout: time.Second, PacketTimeout: time.Second, IPProtocol: "ip4", SourceInterface: "doesnotexist0"}
+	_, err := performPing(context.Background(), &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, module, promslog.NewNopLogger())
+	if err == nil || err.Error() != `source interface "doesnotexist0" does not exist` {
+		t.Errorf("performPing() error = %v, want unknown interface error", err)
+	}
+}
+
+func TestPerformPingSourceIP(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	module := Module{Count: 1, Interval: time.Second, PacketSize: 64, Timeout: time.Second, PacketTimeout: time.Second, IPProtocol: "ip4", SourceIP: "::1"}
+
+	_, err := performPing(context.Background(), dst, module, logger)
+	if err == nil || !strings.Contains(err.Error(), "same address family") {
+		t.Errorf("performPing() error = %v, want address family mismatch", err)
+	}
+
+	// 203.0.113.0/24 is reserved for documentation and not assigned locally
+	module.SourceIP = "203.0.113.254"
+	before := testutil.ToFloat64(sourceBindErrors)
+	_, err = performPing(context.Background(), dst, module, logger)
+	var be *bindError
+	if !errors.As(err, &be) {
+		t.Skipf("Cannot open ICMP socket in this environment: %v", err)
+	}
+	if got := testutil.ToFloat64(sourceBindErrors) - before; got != 1 {
+		t.Errorf("source_bind_errors_total increased by %v, want 1", got)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Packet sizes below include the IP header, as MTUs do.
+const (
+	// minimum MTUs every link must support (RFC 791, RFC 8200)
+	minMTU4 = 68
+	minMTU6 = 1280
+	// maxMTU is the largest IPv4 datagram and the size the search starts
+	// from, so that only the local interface limits it.
+	maxMTU = 65535
+)
+
+// PMTUStats holds the result of a path MTU probe.
+type PMTUStats struct {
+	// PathMTU is the size of the largest echo request that got a reply, or
+	// 0 if not even a minimum size request did.
+	PathMTU int
+	// Probes is the number of echo requests sent.
+	Probes int
+	// Complete is set when the search finished before the probe timeout.
+	Complete bool
+	// PacketsFragmentationNeeded and NextHopMTU are as in PingStats.
+	PacketsFragmentationNeeded int
+	NextHopMTU                 int
+}
+
+// pmtuResult is the outcome of the echo requests of one size.
+type pmtuResult int
+
+const (
+	pmtuOK      pmtuResult = iota // a reply arrived
+	pmtuTooBig                    // a router or the local stack refused the size
+	pmtuNoReply                   // lost, or dropped by a black hole
+)
+
+// searchPMTU binary searches the largest size between lo and hi for which
+// try reports pmtuOK, assuming every smaller size works too. A next-hop MTU
+// reported with pmtuTooBig lowers the upper bound and is tried next, which
+// usually finds the path MTU in a few steps. lo itself is tried first; if
+// it fails, 0 is returned. The search stops early when ctx is done.
+func searchPMTU(ctx context.Context, lo, hi int, try func(size int) (pmtuResult, int)) (int, bool) {
+	if res, _ := try(lo); res != pmtuOK {
+		return 0, ctx.Err() == nil
+	}
+	hint := 0
+	for lo < hi {
+		if ctx.Err() != nil {
+			return lo, false
+		}
+		size := lo + (hi-lo+1)/2
+		if hint > lo && hint <= hi {
+			size = hint
+		}
+		hint = 0
+
+		res, mtu := try(size)
+		switch {
+		case res == pmtuOK:
+			lo = size
+		case res == pmtuTooBig && mtu > lo && mtu < size:
+			hi, hint = mtu, mtu
+		default:
+			hi = size - 1
+		}
+	}
+	return lo, ctx.Err() == nil
+}
+
+// performPMTU finds the path MTU to dstAddr with echo requests that may not
+// be fragmented. Each size is sent up to module.Count times, and counts as
+// too big once a router reports so or none of them gets a reply.
+func performPMTU(ctx context.Context, dstAddr *net.IPAddr, module Module, logger *slog.Logger) (*PMTUStats, error) {
+	module.DontFragment = true
+	session, err := newEchoSession(dstAddr, module, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer session.close()
+
+	// Headers of the echo requests: IP and ICMP
+	lo, headers := minMTU4, 20+8
+	if dstAddr.IP.To4() == nil {
+		lo, headers = minMTU6, 40+8
+	}
+
+	stats := &PMTUStats{}
+	try := func(size int) (pmtuResult, int) {
+		session.size = size - headers
+		for attempt := 0; attempt < module.Count && ctx.Err() == nil; attempt++ {
+			received := session.stats.PacketsReceived
+			fragNeeded := session.stats.PacketsFragmentationNeeded
+			icmpErrors := len(session.stats.ICMPErrors)
+
+			stats.Probes++
+			session.send()
+			session.wait(ctx)
+
+			if session.stats.PacketsReceived > received {
+				logger.Debug("Path MTU probe succeeded", "size", size)
+				return pmtuOK, 0
+			}
+			if session.stats.PacketsFragmentationNeeded > fragNeeded {
+				mtu := 0
+				for _, e := range session.stats.ICMPErrors[icmpErrors:] {
+					if e.FragmentationNeeded {
+						mtu = e.MTU
+					}
+				}
+				logger.Debug("Path MTU probe too big", "size", size, "next_hop_mtu", mtu)
+				return pmtuTooBig, mtu
+			}
+		}
+		logger.Debug("Path MTU probe got no reply", "size", size)
+		return pmtuNoReply, 0
+	}
+
+	stats.PathMTU, stats.Complete = searchPMTU(ctx, lo, maxMTU, try)
+	stats.PacketsFragmentationNeeded = session.stats.PacketsFragmentationNeeded
+	stats.NextHopMTU = session.stats.NextHopMTU
+	logger.Info("Path MTU search finished", "path_mtu", stats.PathMTU, "probes", stats.Probes, "complete", stats.Complete)
+	return stats, nil
+}
+
+func probePMTU(ctx context.Context, dstAddr *net.IPAddr, module Module, registry *prometheus.Registry, logger *slog.Logger) bool {
+	stats, err := performPMTU(ctx, dstAddr, module, logger)
+	if err != nil {
+		logger.Error("Path MTU probe failed", "err", err)
+		return false
+	}
+	registerPMTUMetrics(registry, stats)
+	return stats.Complete && stats.PathMTU > 0
+}
+
+func registerPMTUMetrics(registry *prometheus.Registry, stats *PMTUStats) {
+	pathMTU := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_path_mtu_bytes",
+		Help: "Size in bytes, IP header included, of the largest unfragmented ICMP packet that got a reply",
+	})
+	pathMTU.Set(float64(stats.PathMTU))
+	registry.MustRegister(pathMTU)
+
+	probes := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_path_mtu_probes",
+		Help: "Number of ICMP packets sent to find the path MTU",
+	})
+	probes.Set(float64(stats.Probes))
+	registry.MustRegister(probes)
+
+	packetsFragmentationNeeded := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_packets_fragmentation_needed",
+		Help: "Number of ICMP packets that exceeded the path MTU and could not be fragmented",
+	})
+	packetsFragmentationNeeded.Set(float64(stats.PacketsFragmentationNeeded))
+	registry.MustRegister(packetsFragmentationNeeded)
+
+	if stats.NextHopMTU > 0 {
+		nextHopMTU := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_ping_next_hop_mtu_bytes",
+			Help: "Smallest next-hop MTU reported by fragmentation needed or packet too big errors",
+		})
+		nextHopMTU.Set(float64(stats.NextHopMTU))
+		registry.MustRegister(nextHopMTU)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+)
+
+func TestSearchPMTU(t *testing.T) {
+	tests := []struct {
+		name      string
+		pathMTU   int
+		reportMTU bool // routers report the next-hop MTU
+		blackHole bool // oversized packets are dropped silently
+		want      int
+		maxTries  int
+	}{
+		{name: "reported", pathMTU: 1400, reportMTU: true, want: 1400, maxTries: 3},
+		{name: "unreported", pathMTU: 1400, want: 1400, maxTries: 18},
+		{name: "black hole", pathMTU: 1492, blackHole: true, want: 1492, maxTries: 18},
+		{name: "broken", pathMTU: 0, want: 0, maxTries: 1},
+	}
+	for _, tt := range tests {
+		tries := 0
+		got, complete := searchPMTU(context.Background(), minMTU4, maxMTU, func(size int) (pmtuResult, int) {
+			tries++
+			switch {
+			case size <= tt.pathMTU:
+				return pmtuOK, 0
+			case tt.blackHole || tt.pathMTU == 0:
+				return pmtuNoReply, 0
+			case tt.reportMTU:
+				return pmtuTooBig, tt.pathMTU
+			}
+			return pmtuTooBig, 0
+		})
+		if got != tt.want || !complete {
+			t.Errorf("%s: searchPMTU() = %d, %t; want %d, true", tt.name, got, complete, tt.want)
+		}
+		if tries > tt.maxTries {
+			t.Errorf("%s: searchPMTU() took %d tries, want at most %d", tt.name, tries, tt.maxTries)
+		}
+	}
+}
+
+func TestSearchPMTUDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	got, complete := searchPMTU(ctx, minMTU4, maxMTU, func(size int) (pmtuResult, int) {
+		cancel()
+		return pmtuOK, 0
+	})
+	if got != minMTU4 || complete {
+		t.Errorf("searchPMTU() = %d, %t; want %d, false", got, complete, minMTU4)
+	}
+}
+
+func TestPerformPMTU(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	module := Module{Count: 1, Interval: time.Second, PacketSize: 64, Timeout: 5 * time.Second, PacketTimeout: time.Second, IPProtocol: "ip4", Mode: modePMTU, DontFragment: true}
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	skipWithoutEngine(t, engineCandidates(dst.IP, nil, module), logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	stats, err := performPMTU(ctx, dst, module, logger)
+	if err != nil {
+		t.Fatalf("performPMTU() error = %v", err)
+	}
+	if !stats.Complete || stats.PathMTU < minMTU4 || stats.Probes == 0 {
+		t.Errorf("performPMTU() = %+v, want a complete search", stats)
+	}
+}
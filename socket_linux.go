@@ -0,0 +1,483 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenICMP opens the socket for an engine. Sockets are created directly
+// rather than through icmp.ListenPacket so that socket options can be set
+// before binding and control messages can be read.
+func listenICMP(key engineKey) (conn net.PacketConn, txTimestamps bool, err error) {
+	err = withNetNS(key.netns, func() error {
+		conn, txTimestamps, err = openSocket(key)
+		return err
+	})
+	return conn, txTimestamps, err
+}
+
+func openSocket(key engineKey) (net.PacketConn, bool, error) {
+	var family, sotype, proto int
+	switch key.network {
+	case "udp4":
+		family, sotype, proto = unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_ICMP
+	case "ip4:icmp":
+		family, sotype, proto = unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_ICMP
+	case "udp6":
+		family, sotype, proto = unix.AF_INET6, unix.SOCK_DGRAM, unix.IPPROTO_ICMPV6
+	case "ip6:ipv6-icmp":
+		family, sotype, proto = unix.AF_INET6, unix.SOCK_RAW, unix.IPPROTO_ICMPV6
+	default:
+		return nil, false, fmt.Errorf("unsupported network %q", key.network)
+	}
+
+	fd, err := unix.Socket(family, sotype|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, false, os.NewSyscallError("socket", err)
+	}
+
+	if sotype == unix.SOCK_DGRAM {
+		// Unprivileged sockets only see ICMP errors through the error queue
+		level, opt := unix.SOL_IP, unix.IP_RECVERR
+		if family == unix.AF_INET6 {
+			level, opt = unix.SOL_IPV6, unix.IPV6_RECVERR
+		}
+		if err := unix.SetsockoptInt(fd, level, opt, 1); err != nil {
+			unix.Close(fd)
+			return nil, false, os.NewSyscallError("setsockopt", err)
+		}
+	}
+
+	txTimestamps := false
+	if key.timestamps {
+		// Kernel timestamps are best effort; packets without one fall back
+		// to userspace timing.
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); err == nil {
+			flags := unix.SOF_TIMESTAMPING_TX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE |
+				unix.SOF_TIMESTAMPING_OPT_ID | unix.SOF_TIMESTAMPING_OPT_TSONLY
+			txTimestamps = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags) == nil
+		}
+	}
+
+	if key.device != "" {
+		if err := unix.BindToDevice(fd, key.device); err != nil {
+			unix.Close(fd)
+			if err == unix.ENODEV {
+				return nil, false, fmt.Errorf("source interface %q does not exist", key.device)
+			}
+			return nil, false, fmt.Errorf("failed to bind to interface %q: %w", key.device, os.NewSyscallError("setsockopt", err))
+		}
+	}
+
+	if key.mark != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(key.mark)); err != nil {
+			unix.Close(fd)
+			return nil, false, fmt.Errorf("failed to set fwmark 0x%x: %w", key.mark, os.NewSyscallError("setsockopt", err))
+		}
+	}
+
+	// Report the TOS or traffic class of received packets
+	if family == unix.AF_INET6 {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+	} else {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, false, os.NewSyscallError("setsockopt", err)
+	}
+	if key.tos > 0 && !key.raw {
+		// Raw sockets write the TOS in their own IP header
+		level, opt := unix.IPPROTO_IP, unix.IP_TOS
+		if family == unix.AF_INET6 {
+			level, opt = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+		}
+		if err := unix.SetsockoptInt(fd, level, opt, key.tos); err != nil {
+			unix.Close(fd)
+			return nil, false, os.NewSyscallError("setsockopt", err)
+		}
+	}
+
+	if key.dontFragment && family == unix.AF_INET6 {
+		// Send packets up to the interface MTU unfragmented, whatever path
+		// MTU the kernel has cached, and fail larger ones with EMSGSIZE
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1); err != nil {
+			unix.Close(fd)
+			return nil, false, os.NewSyscallError("setsockopt", err)
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE); err != nil {
+			unix.Close(fd)
+			return nil, false, os.NewSyscallError("setsockopt", err)
+		}
+	}
+
+	if key.ttl > 0 && !key.raw {
+		// Raw sockets write the TTL in their own IP header
+		level, opt := unix.IPPROTO_IP, unix.IP_TTL
+		if family == unix.AF_INET6 {
+			level, opt = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS
+		}
+		if err := unix.SetsockoptInt(fd, level, opt, key.ttl); err != nil {
+			unix.Close(fd)
+			return nil, false, os.NewSyscallError("setsockopt", err)
+		}
+	}
+
+	sa, err := sockaddr(family, key.address)
+	if err != nil {
+		unix.Close(fd)
+		return nil, false, err
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, false, &bindError{address: key.address, err: os.NewSyscallError("bind", err)}
+	}
+
+	f := os.NewFile(uintptr(fd), "icmp")
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	return conn, txTimestamps, nil
+}
+
+func sockaddr(family int, address string) (unix.Sockaddr, error) {
+	host, zone := address, ""
+	for i := len(address) - 1; i >= 0; i-- {
+		if address[i] == '%' {
+			host, zone = address[:i], address[i+1:]
+			break
+		}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid local address %q", address)
+	}
+
+	if family == unix.AF_INET {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, fmt.Errorf("%s is not an IPv4 address", address)
+		}
+		sa := &unix.SockaddrInet4{}
+		copy(sa.Addr[:], ip4)
+		return sa, nil
+	}
+
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("%s is not an IPv6 address", address)
+	}
+	sa := &unix.SockaddrInet6{}
+	copy(sa.Addr[:], ip.To16())
+	if zone != "" {
+		ifi, err := net.InterfaceByName(zone)
+		if err != nil {
+			return nil, err
+		}
+		sa.ZoneId = uint32(ifi.Index)
+	}
+	return sa, nil
+}
+
+// readPacket reads an ICMP message, preferring the kernel receive
+// timestamp over the time the read returned. Errors the kernel reports for
+// earlier packets, such as ICMP errors, do not fail the read; the error
+// queue is drained and the read retried.
+func (e *icmpEngine) readPacket(b, oob []byte) (int, packetInfo, error) {
+	for {
+		n, oobn, flags, peer, err := e.readMsg(b, oob)
+		info := packetInfo{Peer: peer, Received: time.Now()}
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			e.withFD(func(fd int) { e.readErrorQueue(fd, 0, false) })
+			continue
+		}
+		if err != nil {
+			return 0, info, err
+		}
+		parseReceiveControl(oob[:oobn], &info)
+		info.Truncated = flags&unix.MSG_TRUNC != 0
+		return n, info, nil
+	}
+}
+
+func (e *icmpEngine) readMsg(b, oob []byte) (int, int, int, net.IP, error) {
+	switch c := e.conn.(type) {
+	case *net.IPConn:
+		n, oobn, flags, addr, err := c.ReadMsgIP(b, oob)
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		if e.proto == 1 {
+			// Raw IPv4 sockets deliver the IP header as well
+			n = stripIPv4Header(b, n)
+		}
+		return n, oobn, flags, addr.IP, nil
+	case *net.UDPConn:
+		n, oobn, flags, addr, err := c.ReadMsgUDP(b, oob)
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		return n, oobn, flags, addr.IP, nil
+	}
+	return 0, 0, 0, nil, fmt.Errorf("unexpected connection type %T", e.conn)
+}
+
+func stripIPv4Header(b []byte, n int) int {
+	if n < 20 {
+		return n
+	}
+	hl := int(b[0]&0x0f) << 2
+	if hl < 20 || hl > n {
+		return n
+	}
+	return copy(b, b[hl:n])
+}
+
+// parseReceiveControl fills in the kernel receive timestamp and the TOS
+// or traffic class from the control messages of a received packet.
+func parseReceiveControl(oob []byte, info *packetInfo) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SCM_TIMESTAMPNS:
+			if len(m.Data) >= int(unsafe.Sizeof(unix.Timespec{})) {
+				ts := (*unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+				info.Received, info.KernelTimestamp = time.Unix(ts.Unix()), true
+			}
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS:
+			if len(m.Data) >= 1 {
+				info.TOS, info.HasTOS = int(m.Data[0]), true
+			}
+		case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_TCLASS:
+			if len(m.Data) >= 4 {
+				info.TOS, info.HasTOS = int(*(*int32)(unsafe.Pointer(&m.Data[0]))), true
+			}
+		}
+	}
+}
+
+// sendTimestamp returns the kernel transmit timestamp of the packet just
+// written. It must be called with writeMu held, right after the write.
+// Timestamps are matched to packets by the per-socket counter the kernel
+// reports with SOF_TIMESTAMPING_OPT_ID; stale ones are discarded.
+func (e *icmpEngine) sendTimestamp() (time.Time, bool) {
+	if !e.txTimestamps {
+		return time.Time{}, false
+	}
+	key := e.txKey
+	e.txKey++
+
+	var (
+		sent  time.Time
+		found bool
+	)
+	e.withFD(func(fd int) { sent, found = e.readErrorQueue(fd, key, true) })
+	return sent, found
+}
+
+func (e *icmpEngine) withFD(f func(fd int)) {
+	sc, ok := e.conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) { f(int(fd)) })
+}
+
+// readErrorQueue drains the socket error queue. ICMP errors found there are
+// dispatched to the probes waiting for the quoted echo requests. If wantTx
+// is set, the transmit timestamp with the given key is returned.
+func (e *icmpEngine) readErrorQueue(fd int, txKey uint32, wantTx bool) (time.Time, bool) {
+	var (
+		sent  time.Time
+		found bool
+	)
+	b := make([]byte, 1500)
+	oob := make([]byte, 512)
+	for {
+		n, oobn, _, from, err := unix.Recvmsg(fd, b, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		if err != nil {
+			return sent, found
+		}
+		msg := parseErrorQueueMessage(oob[:oobn])
+		switch {
+		case msg.icmpErr != nil:
+			if dst := sockaddrIP(from); dst != nil {
+				e.dispatchError(b[:n], dst, msg.icmpErr, packetInfo{Received: time.Now()})
+			}
+		case wantTx && msg.hasTimestamp && msg.hasID && msg.id == txKey:
+			sent, found = msg.timestamp, true
+		}
+	}
+}
+
+// errorQueueMessage holds the control messages of an error queue entry.
+type errorQueueMessage struct {
+	timestamp    time.Time
+	hasTimestamp bool
+	id           uint32 // SOF_TIMESTAMPING_OPT_ID counter
+	hasID        bool
+	icmpErr      *icmpError
+}
+
+func parseErrorQueueMessage(oob []byte) errorQueueMessage {
+	var msg errorQueueMessage
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return msg
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SO_TIMESTAMPING:
+			if len(m.Data) >= int(unsafe.Sizeof(unix.ScmTimestamping{})) {
+				st := (*unix.ScmTimestamping)(unsafe.Pointer(&m.Data[0]))
+				msg.timestamp, msg.hasTimestamp = time.Unix(st.Ts[0].Unix()), true
+			}
+		case (m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) ||
+			(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR):
+			eeLen := int(unsafe.Sizeof(unix.SockExtendedErr{}))
+			if len(m.Data) < eeLen {
+				continue
+			}
+			ee := (*unix.SockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			switch ee.Origin {
+			case unix.SO_EE_ORIGIN_TIMESTAMPING:
+				msg.id, msg.hasID = ee.Data, true
+			case unix.SO_EE_ORIGIN_ICMP, unix.SO_EE_ORIGIN_ICMP6:
+				proto := 1
+				if ee.Origin == unix.SO_EE_ORIGIN_ICMP6 {
+					proto = 58
+				}
+				name, ok := icmpErrorType(proto, int(ee.Type))
+				if !ok {
+					continue
+				}
+				msg.icmpErr = &icmpError{Type: name, Code: int(ee.Code), Router: offenderIP(m.Data[eeLen:])}
+				if isFragmentationNeeded(proto, int(ee.Type), int(ee.Code)) {
+					// The kernel reports the next-hop MTU in ee_info
+					msg.icmpErr.FragmentationNeeded = true
+					msg.icmpErr.MTU = int(ee.Info)
+				}
+			}
+		}
+	}
+	return msg
+}
+
+// offenderIP returns the address of the sockaddr following a
+// sock_extended_err (SO_EE_OFFENDER).
+func offenderIP(b []byte) net.IP {
+	if len(b) < 2 {
+		return nil
+	}
+	switch *(*uint16)(unsafe.Pointer(&b[0])) {
+	case unix.AF_INET:
+		if len(b) >= 8 {
+			return net.IPv4(b[4], b[5], b[6], b[7])
+		}
+	case unix.AF_INET6:
+		if len(b) >= 24 {
+			return net.IP(append([]byte(nil), b[8:24]...))
+		}
+	}
+	return nil
+}
+
+func sockaddrIP(sa unix.Sockaddr) net.IP {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(append([]byte(nil), sa.Addr[:]...))
+	case *unix.SockaddrInet6:
+		return net.IP(append([]byte(nil), sa.Addr[:]...))
+	}
+	return nil
+}
+
+// dialControl applies the socket settings of module to the sockets
+// dialed for TCP and UDP pings.
+func dialControl(module Module) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		family := unix.AF_INET
+		if network == "tcp6" || network == "udp6" {
+			family = unix.AF_INET6
+		}
+		var err error
+		if cerr := c.Control(func(fd uintptr) { err = setDialSocketOptions(int(fd), family, module) }); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// setDialSocketOptions binds fd to the source interface and sets its
+// firewall mark, TTL and TOS.
+func setDialSocketOptions(fd, family int, module Module) error {
+	if module.SourceInterface != "" {
+		if err := unix.BindToDevice(fd, module.SourceInterface); err != nil {
+			if err == unix.ENODEV {
+				return fmt.Errorf("source interface %q does not exist", module.SourceInterface)
+			}
+			return fmt.Errorf("failed to bind to interface %q: %w", module.SourceInterface, os.NewSyscallError("setsockopt", err))
+		}
+	}
+	if module.FWMark != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(module.FWMark)); err != nil {
+			return fmt.Errorf("failed to set fwmark 0x%x: %w", module.FWMark, os.NewSyscallError("setsockopt", err))
+		}
+	}
+	if module.TOS > 0 {
+		level, opt := unix.IPPROTO_IP, unix.IP_TOS
+		if family == unix.AF_INET6 {
+			level, opt = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+		}
+		if err := unix.SetsockoptInt(fd, level, opt, module.TOS); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if module.TTL > 0 {
+		level, opt := unix.IPPROTO_IP, unix.IP_TTL
+		if family == unix.AF_INET6 {
+			level, opt = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS
+		}
+		if err := unix.SetsockoptInt(fd, level, opt, module.TTL); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
+
+// swapTTL sets the IPv4 TTL or IPv6 hop limit of the packets the socket
+// sends from now on, and returns the previous one.
+func (e *icmpEngine) swapTTL(ttl int) (int, error) {
+	level, opt := unix.IPPROTO_IP, unix.IP_TTL
+	if e.proto == 58 {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS
+	}
+	prev, err := 0, errors.New("socket does not support socket options")
+	e.withFD(func(fd int) {
+		prev, err = unix.GetsockoptInt(fd, level, opt)
+		if err != nil {
+			err = os.NewSyscallError("getsockopt", err)
+			return
+		}
+		if err = unix.SetsockoptInt(fd, level, opt, ttl); err != nil {
+			err = os.NewSyscallError("setsockopt", err)
+		}
+	})
+	return prev, err
+}
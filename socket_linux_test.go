@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+func TestSockaddr(t *testing.T) {
+	tests := []struct {
+		family  int
+		address string
+		wantErr bool
+	}{
+		{family: unix.AF_INET, address: "0.0.0.0"},
+		{family: unix.AF_INET, address: "192.0.2.1"},
+		{family: unix.AF_INET, address: "::1", wantErr: true},
+		{family: unix.AF_INET6, address: "::"},
+		{family: unix.AF_INET6, address: "fe80::1%lo"},
+		{family: unix.AF_INET6, address: "fe80::1%doesnotexist0", wantErr: true},
+		{family: unix.AF_INET6, address: "192.0.2.1", wantErr: true},
+		{family: unix.AF_INET, address: "invalid", wantErr: true},
+	}
+	for _, tt := range tests {
+		_, err := sockaddr(tt.family, tt.address)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("sockaddr(%d, %q) error = %v, wantErr %v", tt.family, tt.address, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPerformPingKernelTimestamps(t *testing.T) {
+	logger := promslog.New(&promslog.Config{})
+	module := Module{Count: 3, Interval: 10 * time.Millisecond, PacketSize: 64, Timeout: 5 * time.Second, PacketTimeout: 2 * time.Second, IPProtocol: "ip4", KernelTimestamps: true}
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	skipWithoutEngine(t, engineCandidates(dst.IP, nil, module), logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	stats, err := performPing(ctx, dst, module, logger)
+	if err != nil {
+		t.Fatalf("performPing() error = %v", err)
+	}
+
+	if stats.PacketsReceived != module.Count {
+		t.Fatalf("PacketsReceived = %d, want %d", stats.PacketsReceived, module.Count)
+	}
+	if stats.KernelReceiveTimestamps != stats.PacketsReceived {
+		t.Errorf("KernelReceiveTimestamps = %d, want %d", stats.KernelReceiveTimestamps, stats.PacketsReceived)
+	}
+	if stats.KernelSendTimestamps != stats.PacketsReceived {
+		t.Errorf("KernelSendTimestamps = %d, want %d", stats.KernelSendTimestamps, stats.PacketsReceived)
+	}
+	for i, rtt := range stats.RTTs {
+		if rtt <= 0 {
+			t.Errorf("RTT %d = %v, want positive", i, rtt)
+		}
+	}
+}
+
+func TestListenICMPTTL(t *testing.T) {
+	conn, _, err := listenICMP(engineKey{network: "ip4:icmp", address: "0.0.0.0", ttl: 7})
+	if err != nil {
+		t.Skipf("Cannot open ICMP socket in this environment: %v", err)
+	}
+	defer conn.Close()
+
+	ttl, err := ipv4.NewPacketConn(conn).TTL()
+	if err != nil {
+		t.Fatalf("TTL() error = %v", err)
+	}
+	if ttl != 7 {
+		t.Errorf("TTL = %d, want 7", ttl)
+	}
+}
+
+func TestPerformPingReplyTOS(t *testing.T) {
+	logger := promslog.New(&promslog.Config{})
+	module := Module{Count: 2, Interval: 10 * time.Millisecond, PacketSize: 64, Timeout: 5 * time.Second, PacketTimeout: 2 * time.Second, IPProtocol: "ip4", TOS: 184}
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	skipWithoutEngine(t, engineCandidates(dst.IP, nil, module), logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	stats, err := performPing(ctx, dst, module, logger)
+	if err != nil {
+		t.Fatalf("performPing() error = %v", err)
+	}
+	// Linux echoes the TOS of the request in its reply
+	if stats.ReplyTOS[184] != module.Count {
+		t.Errorf("ReplyTOS = %v, want %d replies with TOS 184", stats.ReplyTOS, module.Count)
+	}
+}
+
+func TestListenICMPBindToDevice(t *testing.T) {
+	conn, _, err := listenICMP(engineKey{network: "ip4:icmp", address: "0.0.0.0", device: "lo"})
+	if err != nil {
+		t.Skipf("Cannot open ICMP socket in this environment: %v", err)
+	}
+	conn.Close()
+
+	_, _, err = listenICMP(engineKey{network: "ip4:icmp", address: "0.0.0.0", device: "doesnotexist0"})
+	if err == nil || !strings.Contains(err.Error(), `"doesnotexist0"`) {
+		t.Errorf("listenICMP() error = %v, want error naming the interface", err)
+	}
+}
+
+func TestListenICMPMark(t *testing.T) {
+	conn, _, err := listenICMP(engineKey{network: "ip4:icmp", address: "0.0.0.0", mark: 0x64})
+	if err != nil {
+		t.Skipf("Cannot open marked ICMP socket in this environment: %v", err)
+	}
+	defer conn.Close()
+
+	var mark int
+	var markErr error
+	e := &icmpEngine{conn: conn}
+	e.withFD(func(fd int) { mark, markErr = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK) })
+	if markErr != nil {
+		t.Fatalf("GetsockoptInt(SO_MARK) error = %v", markErr)
+	}
+	if mark != 0x64 {
+		t.Errorf("SO_MARK = 0x%x, want 0x64", mark)
+	}
+}
+
+func TestPerformPingLargePacket(t *testing.T) {
+	logger := promslog.New(&promslog.Config{})
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	for _, size := range []int{9000, 65507 - 8 - 20} {
+		module := Module{Count: 2, Interval: 10 * time.Millisecond, PacketSize: size, Timeout: 5 * time.Second, PacketTimeout: 2 * time.Second, IPProtocol: "ip4"}
+		skipWithoutEngine(t, engineCandidates(dst.IP, nil, module), logger)
+
+		ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+		stats, err := performPing(ctx, dst, module, logger)
+		cancel()
+		if err != nil {
+			t.Fatalf("performPing() error = %v", err)
+		}
+		if stats.PacketsReceived != module.Count || stats.PacketsTruncated != 0 || stats.PacketsCorrupted != 0 {
+			t.Errorf("Size %d: PacketsReceived = %d, PacketsTruncated = %d, PacketsCorrupted = %d; want %d, 0, 0",
+				size, stats.PacketsReceived, stats.PacketsTruncated, stats.PacketsCorrupted, module.Count)
+		}
+	}
+}
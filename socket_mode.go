@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Socket modes select between raw ICMP sockets, which need CAP_NET_RAW, and
+// ICMP datagram sockets, which Linux allows unprivileged processes to open
+// if their group is in net.ipv4.ping_group_range.
+const (
+	socketModeAuto         = "auto"
+	socketModePrivileged   = "privileged"
+	socketModeUnprivileged = "unprivileged"
+)
+
+var socketModeInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "ping_exporter",
+	Name:      "socket_mode",
+	Help:      "ICMP socket mode used by default for each address family, as found by the startup self-test. The mode is \"none\" if no usable socket could be opened.",
+}, []string{"family", "mode"})
+
+func init() {
+	prometheus.MustRegister(socketModeInfo)
+}
+
+// socketSupport records, by address family and socket mode, whether an
+// ICMP socket could be opened.
+type socketSupport map[string]map[string]bool
+
+var (
+	socketSelfTestMu     sync.RWMutex
+	socketSelfTestResult socketSupport
+)
+
+// testSockets tries to open every type of ICMP socket.
+func testSockets() socketSupport {
+	keys := map[string]map[string]engineKey{
+		"ip4": {
+			socketModePrivileged:   {network: "ip4:icmp", address: "0.0.0.0"},
+			socketModeUnprivileged: {network: "udp4", address: "0.0.0.0"},
+		},
+		"ip6": {
+			socketModePrivileged:   {network: "ip6:ipv6-icmp", address: "::"},
+			socketModeUnprivileged: {network: "udp6", address: "::"},
+		},
+	}
+	support := socketSupport{}
+	for family, modes := range keys {
+		support[family] = map[string]bool{}
+		for mode, key := range modes {
+			conn, _, err := listenICMP(key)
+			if err == nil {
+				conn.Close()
+			}
+			support[family][mode] = err == nil
+		}
+	}
+	return support
+}
+
+// mode returns the socket mode probes of the given address family use in
+// socket mode configured, or "none" if that mode is unavailable.
+func (s socketSupport) mode(family, configured string) string {
+	switch configured {
+	case socketModeAuto:
+		// engineCandidates prefers unprivileged sockets
+		if s[family][socketModeUnprivileged] {
+			return socketModeUnprivileged
+		}
+		if s[family][socketModePrivileged] {
+			return socketModePrivileged
+		}
+	default:
+		if s[family][configured] {
+			return configured
+		}
+	}
+	return "none"
+}
+
+// socketSelfTest checks which ICMP sockets can be opened, logs the result
+// and exports the socket mode each address family uses by default.
+func socketSelfTest(configured string, logger log.Logger) socketSupport {
+	support := testSockets()
+	socketModeInfo.Reset()
+	for _, family := range []string{"ip4", "ip6"} {
+		mode := support.mode(family, configured)
+		socketModeInfo.WithLabelValues(family, mode).Set(1)
+		logger := log.With(logger, "family", family, "socket_mode", configured,
+			"privileged", support[family][socketModePrivileged], "unprivileged", support[family][socketModeUnprivileged])
+		if mode == "none" {
+			level.Warn(logger).Log("msg", "No usable ICMP socket, grant CAP_NET_RAW or add the exporter's group to net.ipv4.ping_group_range")
+		} else {
+			level.Info(logger).Log("msg", "ICMP socket self-test", "using", mode)
+		}
+	}
+
+	socketSelfTestMu.Lock()
+	socketSelfTestResult = support
+	socketSelfTestMu.Unlock()
+	return support
+}
+
+// readyHandler reports ready once the socket self-test found a usable ICMP
+// socket in the configured socket mode for at least one address family.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	socketSelfTestMu.RLock()
+	support := socketSelfTestResult
+	socketSelfTestMu.RUnlock()
+
+	if support == nil {
+		http.Error(w, "ICMP socket self-test has not run", http.StatusServiceUnavailable)
+		return
+	}
+	if support.mode("ip4", *socketMode) == "none" && support.mode("ip6", *socketMode) == "none" {
+		http.Error(w, fmt.Sprintf("No ICMP socket can be opened in socket mode %q", *socketMode), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Ready"))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSocketSupportMode(t *testing.T) {
+	support := socketSupport{
+		"ip4": {socketModePrivileged: true, socketModeUnprivileged: true},
+		"ip6": {socketModePrivileged: true, socketModeUnprivileged: false},
+	}
+	tests := []struct {
+		family, configured, want string
+	}{
+		{"ip4", socketModeAuto, socketModeUnprivileged},
+		{"ip4", socketModePrivileged, socketModePrivileged},
+		{"ip6", socketModeAuto, socketModePrivileged},
+		{"ip6", socketModeUnprivileged, "none"},
+		{"ip7", socketModeAuto, "none"},
+	}
+	for _, tt := range tests {
+		if got := support.mode(tt.family, tt.configured); got != tt.want {
+			t.Errorf("mode(%s, %s) = %s, want %s", tt.family, tt.configured, got, tt.want)
+		}
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	setTestFlagDefaults()
+	defer func() { socketSelfTestResult = nil }()
+
+	tests := []struct {
+		support socketSupport
+		mode    string
+		want    int
+	}{
+		{support: nil, mode: socketModeAuto, want: http.StatusServiceUnavailable},
+		{support: socketSupport{"ip4": {socketModePrivileged: true}}, mode: socketModeAuto, want: http.StatusOK},
+		{support: socketSupport{"ip4": {socketModePrivileged: true}}, mode: socketModeUnprivileged, want: http.StatusServiceUnavailable},
+		{support: socketSupport{"ip6": {socketModeUnprivileged: true}}, mode: socketModeUnprivileged, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		socketSelfTestResult = tt.support
+		*socketMode = tt.mode
+		rr := httptest.NewRecorder()
+		readyHandler(rr, httptest.NewRequest("GET", "/-/ready", nil))
+		if rr.Code != tt.want {
+			t.Errorf("readyHandler() with %v in mode %s = %d, want %d", tt.support, tt.mode, rr.Code, tt.want)
+		}
+	}
+	*socketMode = socketModeAuto
+}
@@ -0,0 +1,124 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// listenICMP opens the socket for an engine. Kernel timestamps are only
+// supported on Linux.
+func listenICMP(key engineKey) (net.PacketConn, bool, error) {
+	if key.device != "" {
+		return nil, false, errors.New("source_interface is only supported on Linux")
+	}
+	if key.netns != "" {
+		return nil, false, errors.New("netns is only supported on Linux")
+	}
+	if key.mark != 0 {
+		return nil, false, errors.New("fwmark is only supported on Linux")
+	}
+	if key.dontFragment {
+		return nil, false, errors.New("dont_fragment for IPv6 is only supported on Linux")
+	}
+	if key.raw {
+		// Raw sockets write the TTL and TOS in their own IP header
+		conn, err := net.ListenPacket(key.network, key.address)
+		if errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return nil, false, &bindError{address: key.address, err: err}
+		}
+		return conn, false, err
+	}
+	conn, err := icmp.ListenPacket(key.network, key.address)
+	if errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return nil, false, &bindError{address: key.address, err: err}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if p := conn.IPv4PacketConn(); p != nil {
+		if key.ttl > 0 {
+			err = p.SetTTL(key.ttl)
+		}
+		if err == nil && key.tos > 0 {
+			err = p.SetTOS(key.tos)
+		}
+	} else if p := conn.IPv6PacketConn(); p != nil {
+		if key.ttl > 0 {
+			err = p.SetHopLimit(key.ttl)
+		}
+		if err == nil && key.tos > 0 {
+			err = p.SetTrafficClass(key.tos)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+// readPacket reads an ICMP message, timestamped in userspace.
+func (e *icmpEngine) readPacket(b, oob []byte) (int, packetInfo, error) {
+	n, peer, err := e.conn.ReadFrom(b)
+	info := packetInfo{Received: time.Now()}
+	if err != nil {
+		return 0, info, err
+	}
+	switch addr := peer.(type) {
+	case *net.IPAddr:
+		info.Peer = addr.IP
+	case *net.UDPAddr:
+		info.Peer = addr.IP
+	}
+	return n, info, nil
+}
+
+func (e *icmpEngine) sendTimestamp() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// dialControl rejects the socket settings that are only supported on
+// Linux.
+func dialControl(module Module) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		switch {
+		case module.SourceInterface != "":
+			return errors.New("source_interface is only supported on Linux")
+		case module.FWMark != 0:
+			return errors.New("fwmark is only supported on Linux")
+		case module.TTL != 0 || module.TOS != 0:
+			return errors.New("ttl and tos for TCP and UDP are only supported on Linux")
+		}
+		return nil
+	}
+}
+
+// swapTTL sets the IPv4 TTL or IPv6 hop limit of the packets the socket
+// sends from now on, and returns the previous one.
+func (e *icmpEngine) swapTTL(ttl int) (int, error) {
+	conn, ok := e.conn.(*icmp.PacketConn)
+	if !ok {
+		return 0, errors.New("socket does not support setting the TTL")
+	}
+	if p := conn.IPv4PacketConn(); p != nil {
+		prev, err := p.TTL()
+		if err != nil {
+			return 0, err
+		}
+		return prev, p.SetTTL(ttl)
+	}
+	if p := conn.IPv6PacketConn(); p != nil {
+		prev, err := p.HopLimit()
+		if err != nil {
+			return 0, err
+		}
+		return prev, p.SetHopLimit(ttl)
+	}
+	return 0, errors.New("socket does not support setting the TTL")
+}
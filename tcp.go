@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTCPPinger returns a pinger sending SYNs on a raw socket, which
+// measures the RTT most precisely, or connecting sockets if raw sockets are
+// unavailable or the socket mode forbids them.
+func newTCPPinger(ctx context.Context, dstAddr *net.IPAddr, module Module, results chan<- transportResult, logger *slog.Logger) (transportPinger, error) {
+	if module.SocketMode != socketModeUnprivileged {
+		p, err := newTCPRawPinger(dstAddr, module, results)
+		if err == nil {
+			logger.Debug("Using raw TCP socket")
+			return p, nil
+		}
+		// connect() cannot bind to a source address the raw socket cannot
+		// bind to either
+		var be *bindError
+		if module.SocketMode == socketModePrivileged || errors.As(err, &be) {
+			return nil, err
+		}
+		logger.Debug("Cannot open raw TCP socket, timing connect() instead", "err", err)
+	}
+	return &tcpConnectPinger{ctx: ctx, dstAddr: dstAddr, module: module, results: results}, nil
+}
+
+// tcpConnectPinger times connect(), which needs no privileges. The RTT
+// includes the time the kernel takes to hand the connection over.
+type tcpConnectPinger struct {
+	ctx     context.Context
+	dstAddr *net.IPAddr
+	module  Module
+	results chan<- transportResult
+}
+
+func (p *tcpConnectPinger) start(index int) (time.Time, error) {
+	dialer := &net.Dialer{
+		Timeout: p.module.PacketTimeout,
+		Control: dialControl(p.module),
+	}
+	if p.module.SourceIP != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(p.module.SourceIP)}
+	}
+	address := net.JoinHostPort((&net.IPAddr{IP: p.dstAddr.IP, Zone: p.dstAddr.Zone}).String(), strconv.Itoa(p.module.Port))
+
+	sent := time.Now()
+	go func() {
+		var conn net.Conn
+		err := withNetNS(p.module.NetNS, func() error {
+			var err error
+			conn, err = dialer.DialContext(p.ctx, "tcp", address)
+			return err
+		})
+		r := transportResult{index: index, received: time.Now()}
+		switch {
+		case err == nil:
+			conn.Close()
+		case errors.Is(err, syscall.ECONNREFUSED):
+			r.refused = true
+		default:
+			r.err = err
+		}
+		p.results <- r
+	}()
+	return sent, nil
+}
+
+func (p *tcpConnectPinger) close() {}
+
+func registerTCPMetrics(registry *prometheus.Registry, stats *PingStats) {
+	tcpResets := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_tcp_resets",
+		Help: "Number of TCP handshakes answered with a reset because the port is closed",
+	})
+	tcpResets.Set(float64(stats.TCPResets))
+	registry.MustRegister(tcpResets)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCP header flags
+const (
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// tcpRawPinger sends SYNs on a raw socket and takes the SYN-ACK or reset of
+// the target as the answer. The kernel, which knows nothing of the
+// connection, resets it in turn, so the target is left no half-open
+// connection.
+type tcpRawPinger struct {
+	conn    net.PacketConn
+	dst     *net.IPAddr
+	src     net.IP
+	dstPort int
+	// srcPort is held by reserved for the lifetime of the pinger, so that
+	// no connection of the host uses it.
+	srcPort  int
+	reserved int
+	// isn is the sequence number of the first SYN; SYN index uses isn+index.
+	isn       uint32
+	results   chan<- transportResult
+	closeOnce sync.Once
+}
+
+func newTCPRawPinger(dstAddr *net.IPAddr, module Module, results chan<- transportResult) (transportPinger, error) {
+	p := &tcpRawPinger{
+		dst:     dstAddr,
+		dstPort: module.Port,
+		isn:     rand.Uint32(),
+		results: results,
+	}
+	if err := withNetNS(module.NetNS, func() error { return p.open(module) }); err != nil {
+		return nil, err
+	}
+	go p.readLoop()
+	return p, nil
+}
+
+func (p *tcpRawPinger) open(module Module) error {
+	family := unix.AF_INET
+	if p.dst.IP.To4() == nil {
+		family = unix.AF_INET6
+	}
+
+	// The kernel fills in the IP header, but the TCP checksum covers the
+	// source address, so it must be known up front.
+	if module.SourceIP != "" {
+		p.src = net.ParseIP(module.SourceIP)
+	} else {
+		// Connecting a UDP socket picks the source address without
+		// sending anything
+		dialer := &net.Dialer{Control: dialControl(module)}
+		address := net.JoinHostPort(p.dst.String(), strconv.Itoa(p.dstPort))
+		conn, err := dialer.Dial("udp", address)
+		if err != nil {
+			return fmt.Errorf("failed to find the source address for %s: %w", p.dst, err)
+		}
+		p.src = conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+	}
+	sa, err := sockaddr(family, p.src.String())
+	if err != nil {
+		return err
+	}
+
+	reserved, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(reserved, sa); err != nil {
+		unix.Close(reserved)
+		return &bindError{address: p.src.String(), err: os.NewSyscallError("bind", err)}
+	}
+	bound, err := unix.Getsockname(reserved)
+	if err != nil {
+		unix.Close(reserved)
+		return os.NewSyscallError("getsockname", err)
+	}
+	switch bound := bound.(type) {
+	case *unix.SockaddrInet4:
+		p.srcPort = bound.Port
+	case *unix.SockaddrInet6:
+		p.srcPort = bound.Port
+	}
+	p.reserved = reserved
+
+	fd, err := unix.Socket(family, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP)
+	if err != nil {
+		unix.Close(reserved)
+		return os.NewSyscallError("socket", err)
+	}
+	err = setDialSocketOptions(fd, family, module)
+	if err == nil && family == unix.AF_INET6 {
+		// IPv6 raw sockets can have the kernel compute the checksum
+		err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_CHECKSUM, 16))
+	}
+	if err == nil {
+		if err = unix.Bind(fd, sa); err != nil {
+			err = &bindError{address: p.src.String(), err: os.NewSyscallError("bind", err)}
+		}
+	}
+	if err == nil {
+		// A connected raw socket only receives the target's segments,
+		// rather than every TCP segment sent to the source address
+		var dsa unix.Sockaddr
+		if dsa, err = sockaddr(family, p.dst.String()); err == nil {
+			err = os.NewSyscallError("connect", unix.Connect(fd, dsa))
+		}
+	}
+	if err != nil {
+		unix.Close(fd)
+		unix.Close(reserved)
+		return err
+	}
+
+	f := os.NewFile(uintptr(fd), "tcp")
+	p.conn, err = net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		unix.Close(reserved)
+		return err
+	}
+	return nil
+}
+
+func (p *tcpRawPinger) start(index int) (time.Time, error) {
+	syn := make([]byte, 24)
+	binary.BigEndian.PutUint16(syn[0:2], uint16(p.srcPort))
+	binary.BigEndian.PutUint16(syn[2:4], uint16(p.dstPort))
+	binary.BigEndian.PutUint32(syn[4:8], p.isn+uint32(index))
+	syn[12] = 6 << 4 // data offset in 32 bit words
+	syn[13] = tcpFlagSYN
+	binary.BigEndian.PutUint16(syn[14:16], 65535) // window
+	// Maximum segment size option; some stacks ignore SYNs without it
+	syn[20], syn[21] = 2, 4
+	binary.BigEndian.PutUint16(syn[22:24], 1460)
+	if p.dst.IP.To4() != nil {
+		binary.BigEndian.PutUint16(syn[16:18], tcpChecksum(p.src.To4(), p.dst.IP.To4(), syn))
+	}
+
+	sent := time.Now()
+	if _, err := p.conn.WriteTo(syn, p.dst); err != nil {
+		return time.Time{}, fmt.Errorf("failed to send TCP SYN: %w", err)
+	}
+	return sent, nil
+}
+
+// readLoop reports the SYN-ACKs and resets answering our SYNs until the
+// socket is closed. ReadFrom strips the IPv4 header that raw sockets
+// deliver.
+func (p *tcpRawPinger) readLoop() {
+	b := make([]byte, 1500)
+	for {
+		n, peer, err := p.conn.ReadFrom(b)
+		if err != nil {
+			var errno syscall.Errno
+			if errors.As(err, &errno) {
+				continue
+			}
+			return
+		}
+		received := time.Now()
+		if addr, ok := peer.(*net.IPAddr); !ok || !addr.IP.Equal(p.dst.IP) {
+			continue
+		}
+		index, reset, ok := p.parseAnswer(b[:n])
+		if !ok {
+			continue
+		}
+		select {
+		case p.results <- transportResult{index: index, received: received, refused: reset}:
+		default:
+		}
+	}
+}
+
+// parseAnswer matches a TCP segment to the SYN it answers.
+func (p *tcpRawPinger) parseAnswer(b []byte) (int, bool, bool) {
+	if len(b) < 20 {
+		return 0, false, false
+	}
+	if int(binary.BigEndian.Uint16(b[0:2])) != p.dstPort || int(binary.BigEndian.Uint16(b[2:4])) != p.srcPort {
+		return 0, false, false
+	}
+	flags := b[13]
+	if flags&tcpFlagACK == 0 || flags&(tcpFlagSYN|tcpFlagRST) == 0 {
+		return 0, false, false
+	}
+	index := int(binary.BigEndian.Uint32(b[8:12]) - 1 - p.isn)
+	if index < 0 || index > 65535 {
+		return 0, false, false
+	}
+	return index, flags&tcpFlagRST != 0, true
+}
+
+func (p *tcpRawPinger) close() {
+	p.closeOnce.Do(func() {
+		p.conn.Close()
+		unix.Close(p.reserved)
+	})
+}
+
+// tcpChecksum returns the checksum of an IPv4 TCP segment.
+func tcpChecksum(src, dst net.IP, segment []byte) uint16 {
+	pseudo := make([]byte, 0, 12+len(segment))
+	pseudo = append(pseudo, src...)
+	pseudo = append(pseudo, dst...)
+	pseudo = append(pseudo, 0, unix.IPPROTO_TCP, byte(len(segment)>>8), byte(len(segment)))
+	pseudo = append(pseudo, segment...)
+	if len(pseudo)%2 == 1 {
+		pseudo = append(pseudo, 0)
+	}
+	var sum uint32
+	for i := 0; i < len(pseudo); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudo[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
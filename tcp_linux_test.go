@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTCPChecksum(t *testing.T) {
+	src, dst := net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()
+	segment := make([]byte, 24)
+	binary.BigEndian.PutUint16(segment[0:2], 40000)
+	binary.BigEndian.PutUint16(segment[2:4], 443)
+	binary.BigEndian.PutUint32(segment[4:8], 0x01020304)
+	segment[12], segment[13] = 6<<4, tcpFlagSYN
+	segment[20], segment[21] = 2, 4
+
+	sum := tcpChecksum(src, dst, segment)
+	binary.BigEndian.PutUint16(segment[16:18], sum)
+	// A segment carrying its checksum sums to zero
+	if got := tcpChecksum(src, dst, segment); got != 0 {
+		t.Errorf("tcpChecksum() of checksummed segment = %#04x, want 0", got)
+	}
+}
+
+func TestTCPRawPingerParseAnswer(t *testing.T) {
+	p := &tcpRawPinger{dstPort: 443, srcPort: 40000, isn: 0xfffffffe}
+	answer := func(srcPort, dstPort int, ack uint32, flags byte) []byte {
+		b := make([]byte, 20)
+		binary.BigEndian.PutUint16(b[0:2], uint16(srcPort))
+		binary.BigEndian.PutUint16(b[2:4], uint16(dstPort))
+		binary.BigEndian.PutUint32(b[8:12], ack)
+		b[13] = flags
+		return b
+	}
+
+	tests := []struct {
+		name      string
+		b         []byte
+		wantIndex int
+		wantReset bool
+		wantOK    bool
+	}{
+		{name: "syn-ack", b: answer(443, 40000, 0xffffffff, tcpFlagSYN|tcpFlagACK), wantIndex: 0, wantOK: true},
+		{name: "reset, sequence wrapped", b: answer(443, 40000, 2, tcpFlagRST|tcpFlagACK), wantIndex: 3, wantReset: true, wantOK: true},
+		{name: "other source port", b: answer(80, 40000, 0xffffffff, tcpFlagSYN|tcpFlagACK)},
+		{name: "other destination port", b: answer(443, 40001, 0xffffffff, tcpFlagSYN|tcpFlagACK)},
+		{name: "bare ack", b: answer(443, 40000, 0xffffffff, tcpFlagACK)},
+		{name: "reset without ack", b: answer(443, 40000, 0xffffffff, tcpFlagRST)},
+		{name: "unknown sequence", b: answer(443, 40000, 0x7fffffff, tcpFlagSYN|tcpFlagACK)},
+		{name: "short", b: answer(443, 40000, 0xffffffff, tcpFlagSYN|tcpFlagACK)[:12]},
+	}
+	for _, tt := range tests {
+		index, reset, ok := p.parseAnswer(tt.b)
+		if ok != tt.wantOK || ok && (index != tt.wantIndex || reset != tt.wantReset) {
+			t.Errorf("%s: parseAnswer() = %d, %v, %v, want %d, %v, %v", tt.name, index, reset, ok, tt.wantIndex, tt.wantReset, tt.wantOK)
+		}
+	}
+}
+
+func TestTCPRawPingerAnswerLikeIPv4Header(t *testing.T) {
+	// Segments from a port whose first byte reads as a valid IPv4 header
+	// length must not be stripped of one
+	var listener net.Listener
+	for _, port := range []int{0x4605, 0x5605, 0x9605} {
+		var err error
+		if listener, err = net.Listen("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+			break
+		}
+	}
+	if listener == nil {
+		t.Skip("No suitable port free")
+	}
+	defer listener.Close()
+
+	results := make(chan transportResult, 1)
+	module := Module{Port: listener.Addr().(*net.TCPAddr).Port}
+	p, err := newTCPRawPinger(&net.IPAddr{IP: net.ParseIP("127.0.0.1")}, module, results)
+	if err != nil {
+		t.Skipf("Cannot open raw TCP socket in this environment: %v", err)
+	}
+	defer p.close()
+	if _, err := p.start(0); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	select {
+	case r := <-results:
+		if r.index != 0 || r.refused {
+			t.Errorf("result = %+v, want SYN-ACK for index 0", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("No answer to SYN")
+	}
+}
+
+func TestTCPRawPingerConnected(t *testing.T) {
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	p, err := newTCPRawPinger(dst, Module{Port: 9}, make(chan transportResult, 1))
+	if err != nil {
+		t.Skipf("Cannot open raw TCP socket in this environment: %v", err)
+	}
+	defer p.close()
+
+	// The kernel only delivers the segments of the socket's peer, which
+	// for raw sockets shows in the raw socket table rather than through
+	// getpeername. Other tests may leave the main thread, which /proc/net
+	// follows, in another network namespace.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	rc, err := p.(*tcpRawPinger).conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn() error = %v", err)
+	}
+	var link string
+	rc.Control(func(fd uintptr) { link, err = os.Readlink("/proc/self/fd/" + strconv.Itoa(int(fd))) })
+	if err != nil {
+		t.Fatalf("Readlink() error = %v", err)
+	}
+	inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+	table, err := os.ReadFile("/proc/thread-self/net/raw")
+	if err != nil {
+		t.Skipf("Cannot read raw socket table: %v", err)
+	}
+	for _, line := range strings.Split(string(table), "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) > 9 && fields[9] == inode {
+			if fields[2] != "0100007F:0000" {
+				t.Errorf("Raw TCP socket has remote address %s, want 127.0.0.1 (0100007F:0000)", fields[2])
+			}
+			return
+		}
+	}
+	t.Errorf("Raw TCP socket %s not found in the raw socket table", link)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// newTCPRawPinger fails: raw TCP sockets are only supported on Linux.
+func newTCPRawPinger(dstAddr *net.IPAddr, module Module, results chan<- transportResult) (transportPinger, error) {
+	return nil, errors.New("raw TCP sockets are only supported on Linux")
+}
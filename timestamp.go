@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// timestampLen is the size of the originate, receive and transmit
+// timestamps of ICMP timestamp messages (RFC 792).
+const timestampLen = 12
+
+// day is the period of ICMP timestamps, which count milliseconds since
+// midnight UT.
+const day = 24 * time.Hour
+
+// oneWayDelay holds the one-way delays estimated from a timestamp reply.
+// Each includes the offset of the target's clock, with opposite signs, so
+// only their sum, the RTT, is exact; assuming a symmetric path, half their
+// difference is the clock offset. The target reports milliseconds, which
+// caps their precision.
+type oneWayDelay struct {
+	Forward time.Duration // remote receive time minus local send time
+	Return  time.Duration // local receive time minus remote transmit time
+}
+
+// clockOffset returns how far the target's clock is ahead of ours, as in
+// NTP.
+func (d oneWayDelay) clockOffset() time.Duration {
+	return (d.Forward - d.Return) / 2
+}
+
+// sinceMidnight returns the time of day of t in UT.
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.UnixNano() % int64(day))
+}
+
+// millisecondsSinceMidnight returns t as an ICMP timestamp.
+func millisecondsSinceMidnight(t time.Time) uint32 {
+	return uint32(sinceMidnight(t) / time.Millisecond)
+}
+
+// timeOfDayDiff returns a - b for two times of day, the short way around
+// midnight.
+func timeOfDayDiff(a, b time.Duration) time.Duration {
+	d := (a - b) % day
+	switch {
+	case d > day/2:
+		d -= day
+	case d <= -day/2:
+		d += day
+	}
+	return d
+}
+
+// parseTimestamps estimates the one-way delays of a timestamp request sent
+// at sent from the timestamps b of its reply, received at received. Targets
+// set the high bit of timestamps that are not milliseconds since midnight
+// UT, which cannot be compared with ours. Ours keep their nanoseconds while
+// the target truncates its times to the millisecond, so those are taken to
+// be half a millisecond later, which bounds the error of each delay to half
+// a millisecond rather than biasing it by up to one.
+func parseTimestamps(b []byte, sent, received time.Time) (oneWayDelay, bool) {
+	if len(b) < timestampLen {
+		return oneWayDelay{}, false
+	}
+	receive := binary.BigEndian.Uint32(b[4:8])
+	transmit := binary.BigEndian.Uint32(b[8:12])
+	if time.Duration(receive)*time.Millisecond >= day || time.Duration(transmit)*time.Millisecond >= day {
+		return oneWayDelay{}, false
+	}
+	remoteReceive := time.Duration(receive)*time.Millisecond + time.Millisecond/2
+	remoteTransmit := time.Duration(transmit)*time.Millisecond + time.Millisecond/2
+	return oneWayDelay{
+		Forward: timeOfDayDiff(remoteReceive, sinceMidnight(sent)),
+		Return:  timeOfDayDiff(sinceMidnight(received), remoteTransmit),
+	}, true
+}
+
+// receiveTimestamp records the timestamp reply to the outstanding request p.
+func (s *echoSession) receiveTimestamp(reply icmpReply, p *outstandingPacket, duplicate bool) {
+	if len(reply.Data) < timestampLen || !bytes.Equal(reply.Data[:4], p.payload) {
+		// The target copies the originate timestamp into its reply, so a
+		// different one means the reply answers some other request; the
+		// right reply may still come
+		s.stats.PacketsCorrupted++
+		s.logger.Warn("Ignoring timestamp reply with a foreign originate timestamp", "seq", reply.Seq)
+		return
+	}
+	if duplicate {
+		s.stats.PacketsDuplicate++
+		s.logger.Warn("Duplicate ICMP reply", "seq", reply.Seq)
+		return
+	}
+	s.answer(reply, p, p.sent, reply.Peer)
+
+	delay, ok := parseTimestamps(reply.Data, p.sent, reply.Received)
+	if !ok {
+		s.logger.Warn("Timestamp reply carries non-standard timestamps", "seq", reply.Seq)
+		return
+	}
+	s.stats.OneWayDelays = append(s.stats.OneWayDelays, delay)
+	s.logger.Info("Timestamps received", "seq", reply.Seq, "forward_delay", delay.Forward, "return_delay", delay.Return, "clock_offset", delay.clockOffset())
+}
+
+func registerTimestampMetrics(registry *prometheus.Registry, stats *PingStats) {
+	replies := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_timestamp_replies",
+		Help: "Number of ICMP timestamp replies carrying standard timestamps",
+	})
+	replies.Set(float64(len(stats.OneWayDelays)))
+	registry.MustRegister(replies)
+
+	if len(stats.OneWayDelays) == 0 {
+		return
+	}
+	var forward, back time.Duration
+	for _, d := range stats.OneWayDelays {
+		forward += d.Forward
+		back += d.Return
+	}
+	n := time.Duration(len(stats.OneWayDelays))
+	mean := oneWayDelay{Forward: forward / n, Return: back / n}
+
+	forwardDelay := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_timestamp_forward_delay_seconds",
+		Help: "Mean one-way delay to the target estimated from ICMP timestamps, including the target's clock offset",
+	})
+	forwardDelay.Set(mean.Forward.Seconds())
+	registry.MustRegister(forwardDelay)
+
+	returnDelay := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_timestamp_return_delay_seconds",
+		Help: "Mean one-way delay from the target estimated from ICMP timestamps, less the target's clock offset",
+	})
+	returnDelay.Set(mean.Return.Seconds())
+	registry.MustRegister(returnDelay)
+
+	clockOffset := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_timestamp_clock_offset_seconds",
+		Help: "Mean offset of the target's clock from ours estimated from ICMP timestamps, assuming a symmetric path",
+	})
+	clockOffset.Set(mean.clockOffset().Seconds())
+	registry.MustRegister(clockOffset)
+}
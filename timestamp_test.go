@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+// timestamps builds the timestamps of a timestamp reply.
+func timestamps(originate, receive, transmit uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, originate)
+	b = binary.BigEndian.AppendUint32(b, receive)
+	return binary.BigEndian.AppendUint32(b, transmit)
+}
+
+func TestTimeOfDayDiff(t *testing.T) {
+	tests := []struct {
+		a, b time.Duration
+		want time.Duration
+	}{
+		{a: 10 * time.Second, b: 4 * time.Second, want: 6 * time.Second},
+		{a: 4 * time.Second, b: 10 * time.Second, want: -6 * time.Second},
+		{a: time.Second, b: day - time.Second, want: 2 * time.Second},
+		{a: day - time.Second, b: time.Second, want: -2 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := timeOfDayDiff(tt.a, tt.b); got != tt.want {
+			t.Errorf("timeOfDayDiff(%s, %s) = %s, want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseTimestamps(t *testing.T) {
+	midnight := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	// The target's clock is 100ms ahead; 3ms there and 5ms back
+	sent := midnight.Add(time.Hour)
+	received := sent.Add(8 * time.Millisecond)
+	ms := uint32(time.Hour / time.Millisecond)
+	delay, ok := parseTimestamps(timestamps(ms, ms+103, ms+103), sent, received)
+	if !ok {
+		t.Fatal("parseTimestamps() rejected standard timestamps")
+	}
+	// The target's times count from the middle of their millisecond
+	if delay.Forward != 103500*time.Microsecond || delay.Return != -95500*time.Microsecond || delay.clockOffset() != 99500*time.Microsecond {
+		t.Errorf("parseTimestamps() = %+v with clock offset %s, want 103.5ms, -95.5ms and 99.5ms", delay, delay.clockOffset())
+	}
+
+	// Sent before midnight, answered after
+	sent = midnight.Add(-time.Millisecond)
+	delay, ok = parseTimestamps(timestamps(uint32(day/time.Millisecond)-1, 1, 1), sent, sent.Add(4*time.Millisecond))
+	if !ok || delay.Forward != 2500*time.Microsecond || delay.Return != 1500*time.Microsecond {
+		t.Errorf("parseTimestamps() across midnight = %+v, %t; want 2.5ms, 1.5ms", delay, ok)
+	}
+
+	if _, ok := parseTimestamps(timestamps(ms, 1<<31|12345, 1<<31|12345), sent, received); ok {
+		t.Error("parseTimestamps() accepted non-standard timestamps")
+	}
+}
+
+func TestEchoSessionTimestampReply(t *testing.T) {
+	sent := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	originate := millisecondsSinceMidnight(sent)
+	stats := &PingStats{PacketsSent: 2}
+	s := &echoSession{
+		timestamp: true,
+		pending: map[int]*outstandingPacket{
+			7: {index: 1, payload: binary.BigEndian.AppendUint32(nil, originate), sent: sent, deadline: sent.Add(time.Second)},
+			8: {index: 2, payload: binary.BigEndian.AppendUint32(nil, originate), sent: sent, deadline: sent.Add(time.Second)},
+		},
+		answered: map[int]*outstandingPacket{},
+		stats:    stats,
+		logger:   promslog.NewNopLogger(),
+	}
+
+	s.receive(icmpReply{Seq: 7, Data: timestamps(originate+1, originate+2, originate+2), Received: sent.Add(4 * time.Millisecond)})
+	if stats.PacketsCorrupted != 1 || stats.PacketsReceived != 0 {
+		t.Fatalf("PacketsCorrupted = %d, PacketsReceived = %d; want 1, 0", stats.PacketsCorrupted, stats.PacketsReceived)
+	}
+
+	s.receive(icmpReply{Seq: 7, Data: timestamps(originate, originate+1, originate+2), Received: sent.Add(4 * time.Millisecond)})
+	s.receive(icmpReply{Seq: 7, Data: timestamps(originate, originate+1, originate+2), Received: sent.Add(5 * time.Millisecond)})
+	s.receive(icmpReply{Seq: 8, Data: timestamps(originate, 1<<31, 1<<31), Received: sent.Add(6 * time.Millisecond)})
+	if stats.PacketsReceived != 2 || stats.PacketsDuplicate != 1 || len(stats.RTTs) != 2 || stats.RTTs[0] != 4*time.Millisecond {
+		t.Fatalf("PacketsReceived = %d, PacketsDuplicate = %d, RTTs = %v; want 2, 1, [4ms 6ms]", stats.PacketsReceived, stats.PacketsDuplicate, stats.RTTs)
+	}
+	want := []oneWayDelay{{Forward: 1500 * time.Microsecond, Return: 1500 * time.Microsecond}}
+	if len(stats.OneWayDelays) != 1 || stats.OneWayDelays[0] != want[0] {
+		t.Errorf("OneWayDelays = %+v, want %+v", stats.OneWayDelays, want)
+	}
+}
+
+func TestRegisterTimestampMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registerTimestampMetrics(registry, &PingStats{OneWayDelays: []oneWayDelay{
+		{Forward: 3 * time.Millisecond, Return: 1 * time.Millisecond},
+		{Forward: 5 * time.Millisecond, Return: 3 * time.Millisecond},
+	}})
+	expected := `
+# HELP probe_ping_timestamp_clock_offset_seconds Mean offset of the target's clock from ours estimated from ICMP timestamps, assuming a symmetric path
+# TYPE probe_ping_timestamp_clock_offset_seconds gauge
+probe_ping_timestamp_clock_offset_seconds 0.001
+# HELP probe_ping_timestamp_forward_delay_seconds Mean one-way delay to the target estimated from ICMP timestamps, including the target's clock offset
+# TYPE probe_ping_timestamp_forward_delay_seconds gauge
+probe_ping_timestamp_forward_delay_seconds 0.004
+# HELP probe_ping_timestamp_replies Number of ICMP timestamp replies carrying standard timestamps
+# TYPE probe_ping_timestamp_replies gauge
+probe_ping_timestamp_replies 2
+# HELP probe_ping_timestamp_return_delay_seconds Mean one-way delay from the target estimated from ICMP timestamps, less the target's clock offset
+# TYPE probe_ping_timestamp_return_delay_seconds gauge
+probe_ping_timestamp_return_delay_seconds 0.002
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	registry = prometheus.NewRegistry()
+	registerTimestampMetrics(registry, &PingStats{})
+	if n, err := testutil.GatherAndCount(registry); err != nil || n != 1 {
+		t.Errorf("Registered %d metrics without replies, want only the reply count (err %v)", n, err)
+	}
+}
+
+func TestPerformPingTimestamp(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	module := Module{Count: 2, Interval: 100 * time.Millisecond, PacketSize: 64, Timeout: 5 * time.Second, PacketTimeout: time.Second, IPProtocol: "ip4", Mode: modeTimestamp}
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	skipWithoutEngine(t, engineCandidates(dst.IP, nil, module), logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	stats, err := performPing(ctx, dst, module, logger)
+	if err != nil {
+		t.Fatalf("performPing() error = %v", err)
+	}
+	if stats.PacketsReceived != 2 || len(stats.OneWayDelays) != 2 {
+		t.Fatalf("PacketsReceived = %d, OneWayDelays = %+v; want 2 replies with timestamps", stats.PacketsReceived, stats.OneWayDelays)
+	}
+	// The loopback target shares our clock, so the offset is down to the
+	// truncated timestamps, which make it off by up to half a millisecond,
+	// and to the asymmetry of the delays, which includes our own send and
+	// receive latency and is at most the RTT.
+	for i, d := range stats.OneWayDelays {
+		limit := time.Millisecond/2 + stats.RTTs[i]/2
+		if offset := d.clockOffset(); offset < -limit || offset > limit {
+			t.Errorf("Clock offset %s on loopback with RTT %s, want within %s", offset, stats.RTTs[i], limit)
+		}
+	}
+}
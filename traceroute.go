@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tracerouteHop holds the responses to the echo requests sent with one TTL.
+type tracerouteHop struct {
+	TTL int
+	// Stats aggregates the responses of every node answering at this TTL,
+	// so PacketLoss is the loss of the hop.
+	Stats *PingStats
+	// Responders aggregates the responses by address of the answering
+	// node; more than one answers when the path is load balanced.
+	Responders map[string]*PingStats
+}
+
+// TracerouteStats holds the result of a traceroute probe.
+type TracerouteStats struct {
+	// Hops lists the hops up to the target, or up to the last one that
+	// answered if the target was not reached.
+	Hops               []*tracerouteHop
+	DestinationReached bool
+}
+
+// performTraceroute sends module.Count rounds of echo requests to dstAddr,
+// one for every TTL up to module.MaxHops, and collects the TTL exceeded
+// errors of the routers on the way and the replies of the target. Each TTL
+// has its own echo session, and all of them send on the same socket,
+// setting the TTL of each request.
+func performTraceroute(ctx context.Context, dstAddr *net.IPAddr, module Module, logger *slog.Logger) (*TracerouteStats, error) {
+	replies := make(chan icmpReply, 2*module.Count*module.MaxHops)
+	sessions := make([]*echoSession, module.MaxHops)
+	for i := range sessions {
+		hopModule := module
+		hopModule.TTL = 0
+		session, err := newEchoSession(dstAddr, hopModule, logger.With("hop", i+1))
+		if err != nil {
+			return nil, err
+		}
+		defer session.close()
+		session.ttl = i + 1
+		session.replies = replies
+		session.responders = map[string][]time.Duration{}
+		sessions[i] = session
+	}
+
+	// receive hands a reply to the session of the request it answers.
+	// Once the target answers, higher TTLs are no longer sent.
+	hops := len(sessions)
+	target := dstAddr.IP.String()
+	receive := func(reply icmpReply) {
+		for i, s := range sessions {
+			if _, ok := s.pending[reply.Seq]; !ok {
+				if _, ok := s.answered[reply.Seq]; !ok {
+					continue
+				}
+			}
+			s.receive(reply)
+			if _, ok := s.responders[target]; ok && i+1 < hops {
+				hops = i + 1
+			}
+			return
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case reply := <-replies:
+				receive(reply)
+			default:
+				return
+			}
+		}
+	}
+	nextDeadline := func() (time.Time, bool) {
+		var next time.Time
+		for _, s := range sessions {
+			if deadline, ok := s.nextDeadline(); ok && (next.IsZero() || deadline.Before(next)) {
+				next = deadline
+			}
+		}
+		return next, !next.IsZero()
+	}
+
+	sendTimer := time.NewTimer(0)
+	defer sendTimer.Stop()
+	lossTimer := time.NewTimer(0)
+	defer lossTimer.Stop()
+
+	start := time.Now()
+	rounds := 0
+loop:
+	for {
+		var sendC <-chan time.Time
+		if rounds < module.Count {
+			sendC = sendTimer.C
+		}
+		var lossC <-chan time.Time
+		if deadline, ok := nextDeadline(); ok {
+			lossTimer.Reset(time.Until(deadline))
+			lossC = lossTimer.C
+		} else if sendC == nil {
+			break loop
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("Probe deadline reached", "rounds", rounds, "err", ctx.Err())
+			break loop
+		case <-sendC:
+			rounds++
+			logger.Info("Sending traceroute round", "round", rounds, "of", module.Count, "hops", hops)
+			for _, s := range sessions[:hops] {
+				s.send()
+			}
+			if rounds < module.Count {
+				sendTimer.Reset(time.Until(start.Add(time.Duration(rounds) * module.Interval)))
+			}
+		case reply := <-replies:
+			receive(reply)
+		case now := <-lossC:
+			for _, s := range sessions {
+				s.expire(now)
+			}
+		}
+	}
+	drain()
+
+	stats := &TracerouteStats{}
+	last := 0
+	for i, s := range sessions[:hops] {
+		calculateStats(s.stats)
+		hop := &tracerouteHop{TTL: i + 1, Stats: s.stats, Responders: map[string]*PingStats{}}
+		for ip, rtts := range s.responders {
+			responder := &PingStats{PacketsSent: s.stats.PacketsSent, PacketsReceived: len(rtts), RTTs: rtts}
+			calculateStats(responder)
+			hop.Responders[ip] = responder
+		}
+		stats.Hops = append(stats.Hops, hop)
+		if len(hop.Responders) > 0 {
+			last = i + 1
+		}
+		if _, ok := hop.Responders[target]; ok {
+			stats.DestinationReached = true
+			break
+		}
+	}
+	stats.Hops = stats.Hops[:last]
+	logger.Info("Traceroute finished", "hops", len(stats.Hops), "destination_reached", stats.DestinationReached)
+	return stats, nil
+}
+
+func probeTraceroute(ctx context.Context, dstAddr *net.IPAddr, module Module, registry *prometheus.Registry, logger *slog.Logger) bool {
+	stats, err := performTraceroute(ctx, dstAddr, module, logger)
+	if err != nil {
+		logger.Error("Traceroute failed", "err", err)
+		return false
+	}
+	registerTracerouteMetrics(registry, stats)
+	return stats.DestinationReached
+}
+
+func registerTracerouteMetrics(registry *prometheus.Registry, stats *TracerouteStats) {
+	hopRTT := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_traceroute_hop_rtt_seconds",
+		Help: "Mean round-trip time to each node answering at a hop",
+	}, []string{"hop", "ip"})
+	hopLoss := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "probe_traceroute_hop_loss_ratio",
+		Help: "Ratio of the packets sent to a hop that got no answer",
+	}, []string{"hop"})
+	for _, hop := range stats.Hops {
+		label := strconv.Itoa(hop.TTL)
+		hopLoss.WithLabelValues(label).Set(hop.Stats.PacketLoss)
+		for ip, responder := range hop.Responders {
+			hopRTT.WithLabelValues(label, ip).Set(responder.AvgRTT.Seconds())
+		}
+	}
+	registry.MustRegister(hopRTT)
+	registry.MustRegister(hopLoss)
+
+	hops := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_traceroute_hops",
+		Help: "Number of hops to the target, or to the last hop that answered if the target was not reached",
+	})
+	hops.Set(float64(len(stats.Hops)))
+	registry.MustRegister(hops)
+
+	reached := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_traceroute_destination_reached",
+		Help: "Whether the target answered (1) or not (0)",
+	})
+	if stats.DestinationReached {
+		reached.Set(1)
+	}
+	registry.MustRegister(reached)
+}
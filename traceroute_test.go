@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestEchoSessionHopReplies(t *testing.T) {
+	sent := time.Now()
+	router := net.ParseIP("198.51.100.1")
+	stats := &PingStats{PacketsSent: 1}
+	s := &echoSession{
+		pending:    map[int]*outstandingPacket{1: {index: 1, payload: newPayload(32, 42, sent), sent: sent, deadline: sent.Add(time.Second)}},
+		answered:   map[int]*outstandingPacket{},
+		responders: map[string][]time.Duration{},
+		stats:      stats,
+		logger:     promslog.NewNopLogger(),
+	}
+
+	s.receive(icmpReply{Seq: 1, Received: sent.Add(3 * time.Millisecond), Err: &icmpError{Type: "time_exceeded", Code: 0, Router: router}})
+	if stats.PacketsReceived != 1 || stats.PacketsTTLExceeded != 1 {
+		t.Errorf("PacketsReceived = %d, PacketsTTLExceeded = %d; want 1, 1", stats.PacketsReceived, stats.PacketsTTLExceeded)
+	}
+	if rtts := s.responders["198.51.100.1"]; len(rtts) != 1 || rtts[0] != 3*time.Millisecond {
+		t.Errorf("Responders = %v, want 3ms from 198.51.100.1", s.responders)
+	}
+}
+
+func TestRegisterTracerouteMetrics(t *testing.T) {
+	stats := &TracerouteStats{
+		Hops: []*tracerouteHop{
+			{TTL: 1, Stats: &PingStats{PacketLoss: 0}, Responders: map[string]*PingStats{"192.0.2.1": {AvgRTT: 2 * time.Millisecond}}},
+			{TTL: 2, Stats: &PingStats{PacketLoss: 1}, Responders: map[string]*PingStats{}},
+			{TTL: 3, Stats: &PingStats{PacketLoss: 0.5}, Responders: map[string]*PingStats{"198.51.100.7": {AvgRTT: 10 * time.Millisecond}}},
+		},
+		DestinationReached: true,
+	}
+	registry := prometheus.NewRegistry()
+	registerTracerouteMetrics(registry, stats)
+
+	expected := `
+# HELP probe_traceroute_hop_loss_ratio Ratio of the packets sent to a hop that got no answer
+# TYPE probe_traceroute_hop_loss_ratio gauge
+probe_traceroute_hop_loss_ratio{hop="1"} 0
+probe_traceroute_hop_loss_ratio{hop="2"} 1
+probe_traceroute_hop_loss_ratio{hop="3"} 0.5
+# HELP probe_traceroute_hop_rtt_seconds Mean round-trip time to each node answering at a hop
+# TYPE probe_traceroute_hop_rtt_seconds gauge
+probe_traceroute_hop_rtt_seconds{hop="1",ip="192.0.2.1"} 0.002
+probe_traceroute_hop_rtt_seconds{hop="3",ip="198.51.100.7"} 0.01
+# HELP probe_traceroute_hops Number of hops to the target, or to the last hop that answered if the target was not reached
+# TYPE probe_traceroute_hops gauge
+probe_traceroute_hops 3
+# HELP probe_traceroute_destination_reached Whether the target answered (1) or not (0)
+# TYPE probe_traceroute_destination_reached gauge
+probe_traceroute_destination_reached 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPerformTraceroute(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	module := Module{Count: 2, Interval: 10 * time.Millisecond, PacketSize: 64, Timeout: 5 * time.Second, PacketTimeout: time.Second, IPProtocol: "ip4", Mode: modeTraceroute, MaxHops: 3}
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	skipWithoutEngine(t, engineCandidates(dst.IP, nil, module), logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	stats, err := performTraceroute(ctx, dst, module, logger)
+	if err != nil {
+		t.Fatalf("performTraceroute() error = %v", err)
+	}
+	// The loopback address is the first hop
+	if !stats.DestinationReached || len(stats.Hops) != 1 {
+		t.Fatalf("performTraceroute() = %+v, want the target reached at hop 1", stats)
+	}
+	if hop := stats.Hops[0]; hop.Stats.PacketsReceived != module.Count || hop.Responders["127.0.0.1"] == nil {
+		t.Errorf("Hop 1 = %+v, want %d replies from 127.0.0.1", hop.Stats, module.Count)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// transportResult is the outcome of one TCP, UDP, ARP or NDP ping.
+type transportResult struct {
+	index    int
+	received time.Time
+	// refused is set when the target answered with a TCP reset or an ICMP
+	// port unreachable error, i.e. the port is closed.
+	refused bool
+	// responder is the MAC address that answered an ARP request or
+	// neighbor solicitation, or the IPv6 address that sent a neighbor
+	// advertisement without one, in which case withoutMAC is set.
+	responder  string
+	withoutMAC bool
+	// corrupted is set for a datagram that does not echo the UDP ping; the
+	// ping is still waiting for its answer.
+	corrupted bool
+	err       error
+}
+
+// transportPinger sends TCP, UDP, ARP or NDP pings and reports their outcome on the
+// results channel it was created with.
+type transportPinger interface {
+	// start sends ping index and returns the time it was sent.
+	start(index int) (time.Time, error)
+	close()
+}
+
+// checkSourceBind binds a socket to the source address of module up front,
+// as connecting TCP and UDP sockets bind to it for every ping and would
+// report an address the host does not own as loss.
+func checkSourceBind(module Module) error {
+	return withNetNS(module.NetNS, func() error {
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(module.SourceIP, "0"))
+		if err != nil {
+			var serr *os.SyscallError
+			if errors.As(err, &serr) {
+				err = serr
+			}
+			return &bindError{address: module.SourceIP, err: err}
+		}
+		return conn.Close()
+	})
+}
+
+// performTransportPing pings module.Port of dstAddr with TCP handshakes or
+// UDP datagrams, or dstAddr itself with ARP requests or neighbor
+// solicitations, on the same schedule as performPing sends echo requests.
+// As every host owning the address answers those, ARP and NDP pings wait
+// for answers until they time out.
+func performTransportPing(ctx context.Context, dstAddr *net.IPAddr, module Module, logger *slog.Logger) (*PingStats, error) {
+	count := module.Count
+	stats := &PingStats{
+		RTTs: make([]time.Duration, 0, count),
+	}
+
+	if module.SourceIP != "" {
+		srcIP := net.ParseIP(module.SourceIP)
+		if srcIP == nil {
+			return nil, fmt.Errorf("invalid source IP: %s", module.SourceIP)
+		}
+		if (srcIP.To4() == nil) != (dstAddr.IP.To4() == nil) {
+			return nil, fmt.Errorf("source IP %s and target %s are not of the same address family", srcIP, dstAddr.IP)
+		}
+		if module.Protocol == protocolTCP || module.Protocol == protocolUDP {
+			if err := checkSourceBind(module); err != nil {
+				sourceBindErrors.Inc()
+				return nil, err
+			}
+		}
+	}
+
+	results := make(chan transportResult, count)
+	var pinger transportPinger
+	var err error
+	switch module.Protocol {
+	case protocolTCP:
+		pinger, err = newTCPPinger(ctx, dstAddr, module, results, logger)
+	case protocolUDP:
+		pinger = newUDPPinger(ctx, dstAddr, module, results)
+	case protocolARP:
+		pinger, err = newARPPinger(dstAddr, module, results)
+		stats.NeighborResponders = map[string]int{}
+	case protocolNDP:
+		pinger, err = newNDPPinger(dstAddr, module, results)
+		stats.NeighborResponders = map[string]int{}
+		stats.NeighborRespondersWithoutMAC = map[string]int{}
+	default:
+		err = fmt.Errorf("unsupported protocol %q", module.Protocol)
+	}
+	if err != nil {
+		var be *bindError
+		if errors.As(err, &be) {
+			sourceBindErrors.Inc()
+		}
+		return nil, err
+	}
+	defer pinger.close()
+
+	// Pings still outstanding, by index
+	type pendingPing struct {
+		sent     time.Time
+		answered bool
+	}
+	pending := map[int]*pendingPing{}
+	linger := module.Protocol == protocolARP || module.Protocol == protocolNDP
+
+	sendTimer := time.NewTimer(0)
+	defer sendTimer.Stop()
+	lossTimer := time.NewTimer(0)
+	defer lossTimer.Stop()
+
+	start := time.Now()
+	for stats.PacketsSent < count || len(pending) > 0 {
+		var sendC <-chan time.Time
+		if stats.PacketsSent < count {
+			sendC = sendTimer.C
+		}
+		var lossC <-chan time.Time
+		var next time.Time
+		for _, p := range pending {
+			if deadline := p.sent.Add(module.PacketTimeout); next.IsZero() || deadline.Before(next) {
+				next = deadline
+			}
+		}
+		if !next.IsZero() {
+			lossTimer.Reset(time.Until(next))
+			lossC = lossTimer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("Probe deadline reached", "sent", stats.PacketsSent, "outstanding", len(pending), "err", ctx.Err())
+			calculateStats(stats)
+			return stats, nil
+		case <-sendC:
+			logger.Info("Sending ping", "protocol", module.Protocol, "port", module.Port, "packet", stats.PacketsSent+1, "of", count)
+			index := stats.PacketsSent
+			stats.PacketsSent++
+			if sent, err := pinger.start(index); err != nil {
+				logger.Error("Ping failed", "packet", index+1, "err", err)
+			} else {
+				pending[index] = &pendingPing{sent: sent}
+			}
+			if stats.PacketsSent < count {
+				sendTimer.Reset(time.Until(start.Add(time.Duration(stats.PacketsSent) * module.Interval)))
+			}
+		case r := <-results:
+			if r.corrupted {
+				stats.PacketsCorrupted++
+				logger.Warn("Ignoring datagram that does not echo the ping", "packet", r.index+1)
+				continue
+			}
+			if r.withoutMAC {
+				stats.NeighborRespondersWithoutMAC[r.responder]++
+			} else if r.responder != "" {
+				stats.NeighborResponders[r.responder]++
+			}
+			p, ok := pending[r.index]
+			if !ok || p.answered {
+				logger.Debug("Ignoring late or additional answer", "packet", r.index+1, "responder", r.responder)
+				continue
+			}
+			if linger {
+				p.answered = true
+			} else {
+				delete(pending, r.index)
+			}
+			if r.err != nil {
+				logger.Error("Ping failed", "packet", r.index+1, "err", r.err)
+				continue
+			}
+			rtt := r.received.Sub(p.sent)
+			stats.PacketsReceived++
+			stats.RTTs = append(stats.RTTs, rtt)
+			if r.refused {
+				if module.Protocol == protocolTCP {
+					stats.TCPResets++
+				} else {
+					stats.UDPPortUnreachable++
+				}
+			}
+			logger.Info("Ping successful", "packet", r.index+1, "rtt", rtt, "refused", r.refused, "responder", r.responder)
+		case now := <-lossC:
+			for index, p := range pending {
+				if !now.Before(p.sent.Add(module.PacketTimeout)) {
+					delete(pending, index)
+					if !p.answered {
+						logger.Error("Ping failed", "packet", index+1, "err", "timeout waiting for answer")
+					}
+				}
+			}
+		}
+	}
+
+	calculateStats(stats)
+	return stats, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestPerformTransportPing(t *testing.T) {
+	logger := promslog.New(&promslog.Config{})
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	tcpOpen := listener.Addr().(*net.TCPAddr).Port
+
+	// An RFC 862 echo service
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+	udpOpen := echo.LocalAddr().(*net.UDPAddr).Port
+
+	// Ports that were just free are most likely still closed
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	tcpClosed := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+	closedUDP, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	udpClosed := closedUDP.LocalAddr().(*net.UDPAddr).Port
+	closedUDP.Close()
+
+	tests := []struct {
+		protocol    string
+		socketMode  string
+		port        int
+		wantRefused int
+	}{
+		{protocol: protocolTCP, socketMode: socketModeAuto, port: tcpOpen},
+		{protocol: protocolTCP, socketMode: socketModeAuto, port: tcpClosed, wantRefused: 3},
+		{protocol: protocolTCP, socketMode: socketModeUnprivileged, port: tcpOpen},
+		{protocol: protocolTCP, socketMode: socketModeUnprivileged, port: tcpClosed, wantRefused: 3},
+		{protocol: protocolUDP, socketMode: socketModeAuto, port: udpOpen},
+		{protocol: protocolUDP, socketMode: socketModeAuto, port: udpClosed, wantRefused: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.protocol+"/"+tt.socketMode+"/"+strconv.Itoa(tt.port), func(t *testing.T) {
+			module := Module{Count: 3, Interval: 10 * time.Millisecond, PacketSize: 64, Timeout: 5 * time.Second, PacketTimeout: 2 * time.Second, IPProtocol: "ip4", Protocol: tt.protocol, Port: tt.port, SocketMode: tt.socketMode}
+			ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+			defer cancel()
+			stats, err := performTransportPing(ctx, &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, module, logger)
+			if err != nil {
+				t.Fatalf("performTransportPing() error = %v", err)
+			}
+			if stats.PacketsSent != module.Count || stats.PacketsReceived != module.Count {
+				t.Errorf("PacketsSent = %d, PacketsReceived = %d, want %d", stats.PacketsSent, stats.PacketsReceived, module.Count)
+			}
+			refused := stats.TCPResets + stats.UDPPortUnreachable
+			if refused != tt.wantRefused {
+				t.Errorf("TCPResets + UDPPortUnreachable = %d, want %d", refused, tt.wantRefused)
+			}
+		})
+	}
+}
+
+func TestPerformTransportPingSourceBindError(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	dst := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+
+	// 203.0.113.0/24 is reserved for documentation and not assigned locally
+	for _, tt := range []struct{ protocol, socketMode string }{
+		{protocolTCP, socketModeAuto},
+		{protocolTCP, socketModeUnprivileged},
+		{protocolUDP, socketModeAuto},
+	} {
+		t.Run(tt.protocol+"/"+tt.socketMode, func(t *testing.T) {
+			module := Module{Count: 1, Interval: time.Second, PacketSize: 64, Timeout: time.Second, PacketTimeout: time.Second, IPProtocol: "ip4", Protocol: tt.protocol, Port: 7, SocketMode: tt.socketMode, SourceIP: "203.0.113.254"}
+			before := testutil.ToFloat64(sourceBindErrors)
+			_, err := performTransportPing(context.Background(), dst, module, logger)
+			var be *bindError
+			if !errors.As(err, &be) {
+				t.Fatalf("performTransportPing() error = %v, want a bind error", err)
+			}
+			if got := testutil.ToFloat64(sourceBindErrors) - before; got != 1 {
+				t.Errorf("source_bind_errors_total increased by %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestPerformTransportPingUDPCorrupted(t *testing.T) {
+	logger := promslog.NewNopLogger()
+
+	// Answers every datagram with a foreign one before echoing it
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer server.Close()
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := server.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			server.WriteTo(newPayload(n, 42, time.Now()), addr)
+			server.WriteTo(b[:n], addr)
+		}
+	}()
+
+	module := Module{Count: 3, Interval: 10 * time.Millisecond, PacketSize: 64, Timeout: 5 * time.Second, PacketTimeout: 2 * time.Second, IPProtocol: "ip4", Protocol: protocolUDP, Port: server.LocalAddr().(*net.UDPAddr).Port}
+	stats, err := performTransportPing(context.Background(), &net.IPAddr{IP: net.ParseIP("127.0.0.1")}, module, logger)
+	if err != nil {
+		t.Fatalf("performTransportPing() error = %v", err)
+	}
+	if stats.PacketsReceived != 3 || stats.PacketsCorrupted != 3 {
+		t.Errorf("PacketsReceived = %d, PacketsCorrupted = %d; want 3, 3", stats.PacketsReceived, stats.PacketsCorrupted)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// udpPinger sends every datagram from a socket of its own, connected to the
+// target, so that the kernel hands it only the answers to that datagram:
+// the datagram echoed by the target, such as by an RFC 862 echo service, or
+// an ICMP port unreachable error, which connected sockets report as
+// ECONNREFUSED. Neither needs privileges.
+type udpPinger struct {
+	// ctx ends with the probe, or when the pinger is closed.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	dstAddr *net.IPAddr
+	module  Module
+	nonce   uint64
+	results chan<- transportResult
+}
+
+func newUDPPinger(ctx context.Context, dstAddr *net.IPAddr, module Module, results chan<- transportResult) transportPinger {
+	ctx, cancel := context.WithCancel(ctx)
+	return &udpPinger{ctx: ctx, cancel: cancel, dstAddr: dstAddr, module: module, nonce: rand.Uint64(), results: results}
+}
+
+func (p *udpPinger) start(index int) (time.Time, error) {
+	dialer := &net.Dialer{Control: dialControl(p.module)}
+	if p.module.SourceIP != "" {
+		dialer.LocalAddr = &net.UDPAddr{IP: net.ParseIP(p.module.SourceIP)}
+	}
+	address := net.JoinHostPort((&net.IPAddr{IP: p.dstAddr.IP, Zone: p.dstAddr.Zone}).String(), strconv.Itoa(p.module.Port))
+
+	var conn net.Conn
+	err := withNetNS(p.module.NetNS, func() error {
+		var err error
+		conn, err = dialer.DialContext(p.ctx, "udp", address)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	sent := time.Now()
+	payload := newPayload(p.module.PacketSize, p.nonce, sent)
+	if _, err := conn.Write(payload); err != nil {
+		conn.Close()
+		return time.Time{}, err
+	}
+	conn.SetReadDeadline(sent.Add(p.module.PacketTimeout))
+	stop := context.AfterFunc(p.ctx, func() { conn.Close() })
+
+	go func() {
+		defer stop()
+		defer conn.Close()
+		b := make([]byte, receiveBufferSize)
+		for {
+			n, err := conn.Read(b)
+			r := transportResult{index: index, received: time.Now()}
+			switch {
+			case err == nil && !bytes.Equal(b[:n], payload):
+				// Not the echo of the datagram, which may still come; the
+				// results channel only has room for one result per ping
+				select {
+				case p.results <- transportResult{index: index, corrupted: true}:
+				default:
+				}
+				continue
+			case err == nil:
+			case errors.Is(err, syscall.ECONNREFUSED):
+				r.refused = true
+			case errors.Is(err, net.ErrClosed), errors.Is(err, os.ErrDeadlineExceeded):
+				// Lost; performTransportPing times the packet out itself
+				return
+			default:
+				r.err = err
+			}
+			select {
+			case p.results <- r:
+			case <-p.ctx.Done():
+			}
+			return
+		}
+	}()
+	return sent, nil
+}
+
+func (p *udpPinger) close() {
+	p.cancel()
+}
+
+func registerUDPMetrics(registry *prometheus.Registry, stats *PingStats) {
+	udpPortUnreachable := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_ping_udp_port_unreachable",
+		Help: "Number of UDP datagrams answered with an ICMP port unreachable error because the port is closed",
+	})
+	udpPortUnreachable.Set(float64(stats.UDPPortUnreachable))
+	registry.MustRegister(udpPortUnreachable)
+}